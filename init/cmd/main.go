@@ -2,19 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/spf13/cobra"
+	gossh "golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/disks"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/keys"
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/setup"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/ssh"
 )
 
 var configFile string
 
+var forceRemove bool
+
+var dryRun bool
+
 var rootCmd = &cobra.Command{
 	Use:   "tdx-init",
 	Short: "TDX Init - Secure disk encryption and SSH key management",
@@ -27,7 +42,8 @@ var setupCmd = &cobra.Command{
 	Use:   "setup [config]",
 	Short: "Run the TDX setup process",
 	Long: `Runs the complete TDX setup process using configuration from a YAML file.
-This includes disk encryption, SSH key management, and persistent storage setup.`,
+This includes disk encryption, SSH key management, and persistent storage setup.
+With --dry-run it only prints what it would do to each disk.`,
 	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) > 0 {
@@ -50,10 +66,178 @@ var validateCmd = &cobra.Command{
 	},
 }
 
+var shareCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Manage operator keys for Shamir key shares",
+	Long:  `Tools for operators holding shares of a 'shamir' strategy key.`,
+}
+
+var shareKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate an operator key pair",
+	Long: `Generates an X25519 key pair. The public key goes into operator_keys of a
+'shamir' key; keep the private key to decrypt your share.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		generateOperatorKey()
+	},
+}
+
+var shareDecryptCmd = &cobra.Command{
+	Use:   "decrypt <private-key-file>",
+	Short: "Decrypt a share printed at format time",
+	Long: `Reads a TDX_INIT_SHARE line (or its JSON payload) from stdin and prints the
+share to submit to the share pipe or share server.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		decryptShare(args[0])
+	},
+}
+
+var sshCmd = &cobra.Command{
+	Use:   "ssh",
+	Short: "Manage authorized SSH keys after boot",
+	Long: `Adds, removes and lists authorized SSH keys on a running VM. Changes are
+written to authorized_keys and, with store_at, to the LUKS token so they
+survive reboots. Must be run as root on the VM.`,
+}
+
+var sshListCmd = &cobra.Command{
+	Use:   "list [config]",
+	Short: "List authorized SSH keys",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 {
+			configFile = args[0]
+		}
+		listSSHKeys()
+	},
+}
+
+var sshAddCmd = &cobra.Command{
+	Use:   "add [config]",
+	Short: "Authorize SSH keys read from stdin",
+	Long:  `Reads OpenSSH public-key lines from stdin and authorizes them.`,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 {
+			configFile = args[0]
+		}
+		addSSHKeys()
+	},
+}
+
+var sshRemoveCmd = &cobra.Command{
+	Use:   "remove <fingerprint|comment> [config]",
+	Short: "Revoke SSH keys",
+	Long: `Revokes every key whose SHA256 fingerprint (as shown by 'ssh list') or
+comment matches. Removing the last key requires --force.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			configFile = args[1]
+		}
+		removeSSHKeys(args[0])
+	},
+}
+
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey <disk> [config]",
+	Short: "Replace the passphrase of an encrypted disk",
+	Long: `Fetches the current key, obtains a new one from the disk's key provider,
+adds it to the LUKS header, stores it (e.g. in the TPM) and removes the old
+keyslot. The disk accepts the stored key at every step. Must be run as root on
+the VM.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			configFile = args[1]
+		}
+		rekeyDisk(args[0])
+	},
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <disk> [config]",
+	Short: "Print the init token of an encrypted disk",
+	Long: `Prints what the init token in the disk's LUKS header records: schema version,
+creation time, tdx-init version, key strategy and fingerprint, filesystem, disk
+identity, encryption settings and the measurement of the image that formatted
+it.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			configFile = args[1]
+		}
+		inspectDisk(args[0])
+	},
+}
+
+var recoverCmd = &cobra.Command{
+	Use:   "recover",
+	Short: "Recover disks whose key is lost using escrowed recovery keys",
+}
+
+var recoverDiskCmd = &cobra.Command{
+	Use:   "disk <disk> [config]",
+	Short: "Open a disk whose key is lost with its recovery key",
+	Long: `Reads the disk's recovery key (see 'recover decrypt') from stdin, adds a new
+key from the disk's key provider and stores it, escrows a new recovery key and
+removes all other keyslots. Run setup again afterwards. Must be run as root on
+the VM.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			configFile = args[1]
+		}
+		recoverDisk(args[0])
+	},
+}
+
+var recoverShowCmd = &cobra.Command{
+	Use:   "show <disk> [config]",
+	Short: "Print the escrowed recovery key of a disk",
+	Long: `Prints the TDX_INIT_RECOVERY lines kept in the disk's LUKS header, one per
+operator, as printed when the disk was formatted.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			configFile = args[1]
+		}
+		showRecoveryKey(args[0])
+	},
+}
+
+var recoverDecryptCmd = &cobra.Command{
+	Use:   "decrypt <private-key-file>",
+	Short: "Decrypt an escrowed recovery key",
+	Long: `Reads a TDX_INIT_RECOVERY line (or its JSON payload) from stdin and prints the
+recovery key to pass to 'tdx-init recover disk'.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		decryptRecoveryKey(args[0])
+	},
+}
+
 func init() {
 	rootCmd.AddCommand(setupCmd)
+	setupCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print what setup would do without changing anything")
 	rootCmd.AddCommand(validateCmd)
 	rootCmd.AddCommand(generateConfigCmd)
+	rootCmd.AddCommand(shareCmd)
+	shareCmd.AddCommand(shareKeygenCmd)
+	shareCmd.AddCommand(shareDecryptCmd)
+	rootCmd.AddCommand(sshCmd)
+	sshCmd.AddCommand(sshListCmd)
+	sshCmd.AddCommand(sshAddCmd)
+	sshCmd.AddCommand(sshRemoveCmd)
+	sshRemoveCmd.Flags().BoolVar(&forceRemove, "force", false, "allow removing the last key")
+	rootCmd.AddCommand(rekeyCmd)
+	rootCmd.AddCommand(inspectCmd)
+	rootCmd.AddCommand(recoverCmd)
+	recoverCmd.AddCommand(recoverDiskCmd)
+	recoverCmd.AddCommand(recoverShowCmd)
+	recoverCmd.AddCommand(recoverDecryptCmd)
 }
 
 var generateConfigCmd = &cobra.Command{
@@ -83,6 +267,13 @@ func runSetup() {
 		log.Fatalf("Failed to create orchestrator: %v", err)
 	}
 
+	if dryRun {
+		if err := orchestrator.Plan(os.Stdout); err != nil {
+			log.Fatalf("Dry run: %v", err)
+		}
+		return
+	}
+
 	ctx := context.Background()
 	if err := orchestrator.Setup(ctx); err != nil {
 		log.Fatalf("Setup failed: %v", err)
@@ -106,6 +297,222 @@ func validateConfig() {
 	fmt.Print(string(data))
 }
 
+func generateOperatorKey() {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+
+	fmt.Printf("private: %s\n", base64.StdEncoding.EncodeToString(private.Bytes()))
+	fmt.Printf("public:  %s\n", base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()))
+}
+
+func readOperatorKey(privateKeyFile string) *ecdh.PrivateKey {
+	encoded, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to read private key: %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		log.Fatalf("Invalid private key encoding: %v", err)
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		log.Fatalf("Invalid private key: %v", err)
+	}
+	return private
+}
+
+func decryptShare(privateKeyFile string) {
+	private := readOperatorKey(privateKeyFile)
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read share: %v", err)
+	}
+	line := strings.TrimPrefix(strings.TrimSpace(string(input)), "TDX_INIT_SHARE ")
+
+	var shared keys.SharedKey
+	if err := json.Unmarshal([]byte(line), &shared); err != nil {
+		log.Fatalf("Failed to parse share: %v", err)
+	}
+
+	share, err := keys.OpenShare(private, shared)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Println(share)
+}
+
+func newSSHManager() *ssh.Manager {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dm, err := disks.NewManager(cfg, nil)
+	if err != nil {
+		log.Fatalf("Failed to create disk manager: %v", err)
+	}
+
+	sm, err := ssh.NewManager(cfg.SSH, dm)
+	if err != nil {
+		log.Fatalf("Failed to create SSH manager: %v", err)
+	}
+	return sm
+}
+
+func listSSHKeys() {
+	authorized, err := newSSHManager().ListKeys()
+	if err != nil {
+		log.Fatalf("Failed to list SSH keys: %v", err)
+	}
+
+	for _, key := range authorized {
+		fmt.Printf("%s %s %s\n", gossh.FingerprintSHA256(key.Key), key.Key.Type(), key.Comment)
+	}
+}
+
+func addSSHKeys() {
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read SSH keys: %v", err)
+	}
+
+	added, err := newSSHManager().AddKeys(string(input))
+	if err != nil {
+		log.Fatalf("Failed to add SSH keys: %v", err)
+	}
+
+	for _, key := range added {
+		fmt.Printf("added %s %s\n", gossh.FingerprintSHA256(key.Key), key.Comment)
+	}
+}
+
+func removeSSHKeys(selector string) {
+	removed, err := newSSHManager().RemoveKeys(selector, forceRemove)
+	if err != nil {
+		log.Fatalf("Failed to remove SSH keys: %v", err)
+	}
+
+	for _, key := range removed {
+		fmt.Printf("removed %s %s\n", gossh.FingerprintSHA256(key.Key), key.Comment)
+	}
+}
+
+func rekeyDisk(name string) {
+	if err := newDiskManager().Rekey(context.Background(), name); err != nil {
+		log.Fatalf("Failed to rekey disk %s: %v", name, err)
+	}
+}
+
+func newDiskManager() *disks.Manager {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	km, err := keys.NewManager(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create key manager: %v", err)
+	}
+
+	dm, err := disks.NewManager(cfg, km)
+	if err != nil {
+		log.Fatalf("Failed to create disk manager: %v", err)
+	}
+	return dm
+}
+
+func recoverDisk(name string) {
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read recovery key: %v", err)
+	}
+	recoveryKey := strings.TrimSpace(string(input))
+	if recoveryKey == "" {
+		log.Fatalf("No recovery key on stdin")
+	}
+
+	if err := newDiskManager().Recover(context.Background(), name, recoveryKey); err != nil {
+		log.Fatalf("Failed to recover disk %s: %v", name, err)
+	}
+}
+
+func inspectDisk(name string) {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dm, err := disks.NewManager(cfg, nil)
+	if err != nil {
+		log.Fatalf("Failed to create disk manager: %v", err)
+	}
+
+	token, err := dm.InitToken(name)
+	if err != nil {
+		log.Fatalf("Failed to read init token of disk %s: %v", name, err)
+	}
+
+	fields := make([]string, 0, len(token))
+	for field := range token {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fmt.Printf("%s: %s\n", field, token[field])
+	}
+}
+
+func showRecoveryKey(name string) {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dm, err := disks.NewManager(cfg, nil)
+	if err != nil {
+		log.Fatalf("Failed to create disk manager: %v", err)
+	}
+
+	escrowed, err := dm.EscrowedRecoveryKeys(name)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	for _, key := range escrowed {
+		out, err := json.Marshal(key)
+		if err != nil {
+			log.Fatalf("Failed to marshal recovery key: %v", err)
+		}
+		fmt.Printf("TDX_INIT_RECOVERY %s\n", out)
+	}
+}
+
+func decryptRecoveryKey(privateKeyFile string) {
+	private := readOperatorKey(privateKeyFile)
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read recovery key: %v", err)
+	}
+	line := strings.TrimPrefix(strings.TrimSpace(string(input)), "TDX_INIT_RECOVERY ")
+
+	var escrowed keys.EscrowedKey
+	if err := json.Unmarshal([]byte(line), &escrowed); err != nil {
+		log.Fatalf("Failed to parse recovery key: %v", err)
+	}
+
+	recoveryKey, err := keys.OpenRecoveryKey(private, escrowed)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Println(recoveryKey)
+}
+
 func generateConfig() {
 	exampleConfig := `# TDX-Init Configuration File
 # This configuration defines SSH key management, encryption keys, and disk setup
@@ -119,6 +526,16 @@ ssh:
   strategy_config:
     # For webserver strategy: the address to listen on
     server_url: "0.0.0.0:8080"
+    # HTTPS with a TLS key generated in the TD and bound into a TDX quote,
+    # served on GET /attestation. On by default; verify the quote and pin the
+    # TLS key before POSTing. 'false' serves plain HTTP, where the first POST
+    # wins; only for development outside a TD.
+    # tls: true
+    # Only accept keys signed by one of these operator keys (optional)
+    # Clients GET /nonce, sign "<nonce>\n<key>" with
+    # 'ssh-keygen -Y sign -n tdx-init' and POST {"key", "nonce", "signature"}
+    # trusted_signers:
+    #   - "ssh-ed25519 AAAA... operator@example"
   
   # SSH directory where authorized_keys will be created
   dir: "/root/.ssh"
@@ -126,6 +543,9 @@ ssh:
   # Path to store the SSH key separately (optional)
   key_path: "/etc/root_key"
   
+  # authorized_keys options for keys submitted without their own options
+  # key_options: ["no-port-forwarding", "no-agent-forwarding", "no-X11-forwarding"]
+  
   # Store SSH key in LUKS token of specified disk (optional)
   # This allows the key to persist across reboots
   store_at: "disk_persistent"
@@ -135,38 +555,153 @@ keys:
   # Define one or more encryption keys
   key_persistent:
     # Strategy for key generation/retrieval
-    strategy: "random"  # Options: 'random', 'pipe'
+    strategy: "random"  # Options: 'random', 'pipe', 'https', 'kbs', 'shamir'
     
     # For 'pipe' strategy, specify the pipe path:
     # strategy_config:
     #   pipe_path: "/tmp/passphrase"
     
+    # For 'https' strategy, the key is POSTed to /key over TLS. The TLS key
+    # is generated in the TD and bound into the quote at GET /attestation.
+    # The key must be signed by a trusted signer over a nonce from GET
+    # /nonce, as for signed SSH key submissions:
+    # strategy_config:
+    #   listen_addr: "0.0.0.0:8443"
+    #   trusted_signers:
+    #     - "ssh-ed25519 AAAA... operator@example"
+    
+    # For 'kbs' strategy, the key is released by a remote key broker
+    # after it verifies a TDX quote:
+    # strategy_config:
+    #   url: "https://kbs.example.com/v1/release"
+    #   key_id: "prover-persistent"   # optional, passed to the broker
+    #   ca_cert: "/etc/tdx-init/kbs-ca.pem"  # optional CA to trust
+    #   retry_interval: 5             # seconds between attempts
+    #   allow_insecure_http: false    # permit an http:// url, for testing
+    
+    # For 'shamir' strategy, the key is rebuilt from threshold shares.
+    # On format a new key is split and one share per operator key is
+    # printed, encrypted to that operator (see 'tdx-init share'):
+    # strategy_config:
+    #   threshold: 2
+    #   operator_keys: ["<base64 X25519 public key>", "...", "..."]
+    #   share_pipes: ["/tmp/share1", "/tmp/share2"]
+    #   share_server: "0.0.0.0:8081"  # accepts shares via POST to https://<addr>/share,
+    #                                 # attested like the 'https' strategy
+    
     # Store key in TPM if available
     tpm: true
 
+    # Seal the TPM-stored key to a PCR policy (optional, requires tpm: true)
+    # The key can then only be read back when these SHA-256 PCRs match
+    # the values measured at the time the key was stored.
+    # tpm_policy:
+    #   pcrs: [0, 2, 4, 7, 9, 11]
+
+    # TPM NV index holding the key (optional, requires tpm: true)
+    # If omitted, it is derived from the key name within 0x1510000-0x151ffff
+    # and does not change when other keys are added. A lone key without it is
+    # moved there from 0x1500016, where older releases kept it.
+    # Updates stage the key at this index with bit 0x800000 flipped, so that
+    # index must not be used by another key.
+    # nv_index: "0x1500016"
+
 # Disk Configuration
 disks:
   # Define one or more disks to manage
   disk_persistent:
     # Strategy for finding the disk
-    strategy: "largest"  # Options: 'largest', 'pathglob'
+    strategy: "largest"  # Options: 'largest', 'pathglob', 'identity', 'raid', 'partition'
     
     # For 'pathglob' strategy, specify the pattern:
     # strategy_config:
     #   path_glob: "/dev/sd*"
     
+    # For 'identity' strategy, set one or more stable identifiers; all must
+    # match exactly one disk:
+    # strategy_config:
+    #   wwn: "naa.600224800d7e4c5a9a6b3f0e1c2d4b5a"
+    #   serial: "nvme_card-pd"
+    #   by_id: "nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0"
+    #   by_path: "pci-0000:00:04.0-scsi-0:0:1:0"
+    #   azure_lun: 0
+    #   gcp_name: "persistent-disk-1"
+    
+    # For 'raid' strategy, stripe or mirror several disks with md under LUKS.
+    # Without 'devices', every blank disk (no partitions, signatures or
+    # holders) is used, so 'devices' is required when other disks are
+    # configured. Members are found again by array name on later boots.
+    # strategy_config:
+    #   level: "raid0"      # 'raid0' (striped), 'raid1' (mirrored) or 'raid10'
+    #   min_devices: 2
+    #   devices:            # optional, identifiers as for 'identity'
+    #     - azure_lun: 0
+    #     - azure_lun: 1
+    
+    # For 'partition' strategy, use a GPT partition found by its name
+    # (label) and/or PARTUUID (uuid). With 'disk' and 'layout', a missing
+    # partition is created by writing the whole layout as a new GPT to a
+    # blank disk; give every disk sharing that disk the same layout.
+    # strategy_config:
+    #   label: "tdx-data"
+    #   disk:               # finds the whole disk: 'largest', 'pathglob' or 'identity'
+    #     strategy: "largest"
+    #   layout:             # the last partition may omit size to fill the disk
+    #     - label: "tdx-meta"
+    #       size: "1G"
+    #     - label: "tdx-data"
+    
     # When to format the disk
     # - 'always': Format on every run (DESTRUCTIVE!)
     # - 'on_initialize': Format only if not already initialized (default)
+    # - 'on_fail': Format only if mounting the existing disk fails
     # - 'never': Never format, only mount existing filesystems
+    # - 'ephemeral': Encrypt with plain dm-crypt under a one-time key that is
+    #   never stored, so the data is destroyed on every boot (for scratch
+    #   space such as the Azure temp disk or a GCP local SSD). Mounted with
+    #   nodev,nosuid; no encryption_key, recovery or luks.integrity.
     format: "on_initialize"
     
+    # Let 'on_initialize' and 'on_fail' format a disk that holds data
+    # tdx-init did not write, such as another filesystem, a partition table
+    # or a LUKS1 container. Without it such a disk is refused and the
+    # signatures found are reported. ('always' formats regardless.)
+    # allow_wipe_foreign: true
+    
     # Encryption key to use (references a key from 'keys' section)
     # Leave empty for unencrypted disk
     encryption_key: "key_persistent"
     
     # Where to mount the disk
     mount_at: "/persistent"
+    
+    # Filesystem created when formatting: 'ext4' (default) or 'xfs'.
+    # Existing disks are mounted with the filesystem they actually have.
+    # fs_type: "ext4"
+    
+    # Extra mkfs arguments, passed before the device
+    # mkfs_options: ["-i", "65536"]
+    
+    # Mount options
+    # mount_options: ["noatime", "discard"]
+    
+    # LUKS2 encryption settings, used when formatting (cryptsetup defaults if
+    # unset). 'integrity' adds dm-integrity so tampered sectors fail to read:
+    # 'aead' with an AEAD cipher, or 'hmac-sha256', 'hmac-sha512', 'poly1305'
+    # with e.g. aes-xts-plain64. Formatting with integrity wipes the whole disk.
+    # luks:
+    #   cipher: "aes-gcm-random"
+    #   integrity: "aead"
+    #   sector_size: 4096
+    #   key_size: 256
+    
+    # Add a recovery keyslot when formatting (requires encryption_key). Its
+    # key is printed once per operator as a TDX_INIT_RECOVERY line, encrypted
+    # to that operator's key (see 'tdx-init share keygen'), and kept in the
+    # LUKS header. If the disk's key is lost, e.g. after a TPM reset, setup
+    # stops instead of reformatting and 'tdx-init recover disk' opens it.
+    # recovery:
+    #   operator_keys: ["<base64 X25519 public key>"]
 
   # Example of an additional unencrypted disk:
   # disk_data:
@@ -175,6 +710,17 @@ disks:
   #     path_glob: "/dev/nvme*"
   #   format: "on_initialize"
   #   mount_at: "/data"
+
+  # Example of a scratch disk wiped on every boot. The Azure temp disk comes
+  # formatted as NTFS, hence allow_wipe_foreign:
+  # disk_scratch:
+  #   strategy: "pathglob"
+  #   strategy_config:
+  #     path_glob: "/dev/disk/azure/resource"
+  #   format: "ephemeral"
+  #   allow_wipe_foreign: true
+  #   mount_at: "/scratch"
+  #   mount_options: ["noatime", "discard"]
 `
 
 	filename := "config.example.yaml"
@@ -0,0 +1,68 @@
+package attestation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ConfigFSReportPath = "/sys/kernel/config/tsm/report"
+
+type ConfigFSQuoteProvider struct {
+	Path string
+}
+
+func NewConfigFSQuoteProvider(path string) *ConfigFSQuoteProvider {
+	return &ConfigFSQuoteProvider{
+		Path: path,
+	}
+}
+
+func (c *ConfigFSQuoteProvider) EvidenceType() string {
+	return EvidenceTypeQuote
+}
+
+func (c *ConfigFSQuoteProvider) Quote(reportData [ReportDataSize]byte) ([]byte, error) {
+	entry, err := os.MkdirTemp(c.Path, "tdx-init-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create configfs report entry: %w", err)
+	}
+	defer os.Remove(entry)
+
+	if provider, err := os.ReadFile(filepath.Join(entry, "provider")); err == nil {
+		if p := strings.TrimSpace(string(provider)); p != "tdx_guest" {
+			return nil, fmt.Errorf("unexpected configfs-tsm provider %q", p)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(entry, "inblob"), reportData[:], 0600); err != nil {
+		return nil, fmt.Errorf("failed to write report data: %w", err)
+	}
+
+	generation, err := os.ReadFile(filepath.Join(entry, "generation"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report generation: %w", err)
+	}
+
+	quote, err := os.ReadFile(filepath.Join(entry, "outblob"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quote: %w", err)
+	}
+
+	// Another writer touching the entry between inblob and outblob would
+	// bump the generation and the quote would not cover our report data.
+	after, err := os.ReadFile(filepath.Join(entry, "generation"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report generation: %w", err)
+	}
+	if string(after) != string(generation) {
+		return nil, fmt.Errorf("configfs report entry was modified while generating quote")
+	}
+
+	if len(quote) == 0 {
+		return nil, fmt.Errorf("empty quote returned by configfs-tsm")
+	}
+
+	return quote, nil
+}
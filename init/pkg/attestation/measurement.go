@@ -0,0 +1,89 @@
+package attestation
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+const (
+	measurementSize = 48
+
+	// Offsets of MRTD in a TDREPORT (after REPORTMACSTRUCT, TEE_TCB_INFO and
+	// the TDINFO attributes) and in the body of a v4 quote.
+	reportMRTDOffset  = 528
+	quoteV4MRTDOffset = 184
+	// A v5 quote adds a 2-byte body type and 4-byte body size.
+	quoteV5MRTDOffset = quoteV4MRTDOffset + 6
+)
+
+// Measurement identifies the booted image: MRTD covers the firmware and
+// RTMR0-2 the firmware configuration, the kernel and its command line and
+// initrd. RTMR3 is left out as it is extended at runtime.
+type Measurement struct {
+	MRTD  string
+	RTMR0 string
+	RTMR1 string
+	RTMR2 string
+}
+
+// ReadMeasurement reads the measurement of the running TD. A TDREPORT is
+// preferred as it needs no quoting service.
+func ReadMeasurement() (Measurement, error) {
+	var provider QuoteProvider
+	if _, err := os.Stat(TDXGuestDevice); err == nil {
+		provider = NewTDXGuestQuoteProvider(TDXGuestDevice)
+	} else {
+		var err error
+		if provider, err = NewQuoteProvider(); err != nil {
+			return Measurement{}, err
+		}
+	}
+
+	evidence, err := provider.Quote([ReportDataSize]byte{})
+	if err != nil {
+		return Measurement{}, err
+	}
+	return ParseMeasurement(evidence, provider.EvidenceType())
+}
+
+// ParseMeasurement extracts the measurement from a TDREPORT or a TDX quote.
+func ParseMeasurement(evidence []byte, evidenceType string) (Measurement, error) {
+	var offset int
+	switch evidenceType {
+	case EvidenceTypeReport:
+		offset = reportMRTDOffset
+	case EvidenceTypeQuote:
+		if len(evidence) < 2 {
+			return Measurement{}, fmt.Errorf("quote too short")
+		}
+		switch version := binary.LittleEndian.Uint16(evidence); version {
+		case 4:
+			offset = quoteV4MRTDOffset
+		case 5:
+			offset = quoteV5MRTDOffset
+		default:
+			return Measurement{}, fmt.Errorf("unsupported quote version %d", version)
+		}
+	default:
+		return Measurement{}, fmt.Errorf("unknown evidence type %s", evidenceType)
+	}
+
+	// MRTD is followed by MRCONFIGID, MROWNER and MROWNERCONFIG, then the
+	// RTMRs.
+	rtmrOffset := offset + 4*measurementSize
+	if len(evidence) < rtmrOffset+3*measurementSize {
+		return Measurement{}, fmt.Errorf("%s too short", evidenceType)
+	}
+
+	field := func(start int) string {
+		return hex.EncodeToString(evidence[start : start+measurementSize])
+	}
+	return Measurement{
+		MRTD:  field(offset),
+		RTMR0: field(rtmrOffset),
+		RTMR1: field(rtmrOffset + measurementSize),
+		RTMR2: field(rtmrOffset + 2*measurementSize),
+	}, nil
+}
@@ -0,0 +1,39 @@
+package attestation
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"os"
+)
+
+const (
+	EvidenceTypeQuote  = "tdx_quote"
+	EvidenceTypeReport = "tdx_report"
+
+	ReportDataSize = 64
+)
+
+type QuoteProvider interface {
+	// Quote returns evidence binding reportData to the current TD.
+	Quote(reportData [ReportDataSize]byte) ([]byte, error)
+	// EvidenceType reports what Quote returns, so verifiers know how to
+	// parse it.
+	EvidenceType() string
+}
+
+// NewQuoteProvider prefers configfs-tsm, which yields a signed quote, and
+// falls back to a TDREPORT from /dev/tdx_guest on older kernels.
+func NewQuoteProvider() (QuoteProvider, error) {
+	if _, err := os.Stat(ConfigFSReportPath); err == nil {
+		return NewConfigFSQuoteProvider(ConfigFSReportPath), nil
+	}
+	if _, err := os.Stat(TDXGuestDevice); err == nil {
+		return NewTDXGuestQuoteProvider(TDXGuestDevice), nil
+	}
+	return nil, fmt.Errorf("no TDX attestation interface found (%s or %s)", ConfigFSReportPath, TDXGuestDevice)
+}
+
+// ReportDataFor hashes data into the 64-byte report data field of a quote.
+func ReportDataFor(data []byte) [ReportDataSize]byte {
+	return sha512.Sum512(data)
+}
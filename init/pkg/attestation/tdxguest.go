@@ -0,0 +1,53 @@
+package attestation
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	TDXGuestDevice = "/dev/tdx_guest"
+
+	tdReportSize = 1024
+	// _IOWR('T', 1, struct tdx_report_req)
+	tdxCmdGetReport0 = 0xc4405401
+)
+
+type tdxReportReq struct {
+	reportData [ReportDataSize]byte
+	tdReport   [tdReportSize]byte
+}
+
+// TDXGuestQuoteProvider returns a TDREPORT rather than a signed quote. It
+// is only useful to verifiers that can convert the report themselves.
+type TDXGuestQuoteProvider struct {
+	Device string
+}
+
+func NewTDXGuestQuoteProvider(device string) *TDXGuestQuoteProvider {
+	return &TDXGuestQuoteProvider{
+		Device: device,
+	}
+}
+
+func (t *TDXGuestQuoteProvider) EvidenceType() string {
+	return EvidenceTypeReport
+}
+
+func (t *TDXGuestQuoteProvider) Quote(reportData [ReportDataSize]byte) ([]byte, error) {
+	file, err := os.OpenFile(t.Device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", t.Device, err)
+	}
+	defer file.Close()
+
+	req := tdxReportReq{reportData: reportData}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), tdxCmdGetReport0, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return nil, fmt.Errorf("TDX_CMD_GET_REPORT0 failed: %w", errno)
+	}
+
+	return req.tdReport[:], nil
+}
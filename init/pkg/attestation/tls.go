@@ -0,0 +1,120 @@
+package attestation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// AttestedTLS is a TLS identity generated inside the TD whose public key is
+// bound into a quote. Clients fetch the quote, verify it, check that its
+// report data is the SHA-512 of the certificate's SubjectPublicKeyInfo, and
+// then pin the certificate for the actual request.
+type AttestedTLS struct {
+	Certificate  tls.Certificate
+	Quote        []byte
+	EvidenceType string
+}
+
+// Evidence is served on GET /attestation.
+type Evidence struct {
+	EvidenceType string `json:"evidence_type"`
+	Quote        string `json:"quote"`
+	Certificate  string `json:"certificate"`
+	// SPKISHA256 is for pinning with tools such as curl --pinnedpubkey.
+	SPKISHA256 string `json:"spki_sha256"`
+}
+
+func NewAttestedTLS(quoter QuoteProvider, commonName string) (*AttestedTLS, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TLS key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &private.PublicKey, private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TLS certificate: %w", err)
+	}
+
+	quote, err := quoter.Quote(ReportDataFor(cert.RawSubjectPublicKeyInfo))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate quote for TLS key: %w", err)
+	}
+
+	return &AttestedTLS{
+		Certificate: tls.Certificate{
+			Certificate: [][]byte{der},
+			PrivateKey:  private,
+			Leaf:        cert,
+		},
+		Quote:        quote,
+		EvidenceType: quoter.EvidenceType(),
+	}, nil
+}
+
+func (a *AttestedTLS) TLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{a.Certificate},
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// SPKIFingerprint is the hex SHA-256 of the certificate's public key.
+func (a *AttestedTLS) SPKIFingerprint() string {
+	sum := sha256.Sum256(a.Certificate.Leaf.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *AttestedTLS) Evidence() Evidence {
+	sum := sha256.Sum256(a.Certificate.Leaf.RawSubjectPublicKeyInfo)
+	return Evidence{
+		EvidenceType: a.EvidenceType,
+		Quote:        base64.StdEncoding.EncodeToString(a.Quote),
+		Certificate:  base64.StdEncoding.EncodeToString(a.Certificate.Leaf.Raw),
+		SPKISHA256:   base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+// ServeEvidence writes the evidence as JSON for GET /attestation.
+func (a *AttestedTLS) ServeEvidence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(w, "Only GET method is allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Evidence())
+}
@@ -1,10 +1,18 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"hash/fnv"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
 )
 
 type Config struct {
@@ -19,12 +27,24 @@ type SSHConfig struct {
 	Dir            string                 `yaml:"dir"`
 	KeyPath        string                 `yaml:"key_path"`
 	StoreAt        string                 `yaml:"store_at"`
+	// KeyOptions are the authorized_keys options applied to keys that were
+	// submitted without options of their own.
+	KeyOptions []string `yaml:"key_options"`
 }
 
 type KeyConfig struct {
 	Strategy       string                 `yaml:"strategy"`
 	StrategyConfig map[string]interface{} `yaml:"strategy_config"`
 	TPM            bool                   `yaml:"tpm"`
+	TPMPolicy      *TPMPolicyConfig       `yaml:"tpm_policy,omitempty"`
+	NVIndex        string                 `yaml:"nv_index,omitempty"`
+	// LegacyNVIndex is where a release before per-key indices kept this
+	// key, set by Validate when the key may still be there.
+	LegacyNVIndex string `yaml:"-"`
+}
+
+type TPMPolicyConfig struct {
+	PCRs []int `yaml:"pcrs"`
 }
 
 type DiskConfig struct {
@@ -33,6 +53,30 @@ type DiskConfig struct {
 	Format        string                 `yaml:"format"`
 	EncryptionKey string                 `yaml:"encryption_key"`
 	MountAt       string                 `yaml:"mount_at"`
+	FSType        string                 `yaml:"fs_type"`
+	MkfsOptions   []string               `yaml:"mkfs_options,omitempty"`
+	MountOptions  []string               `yaml:"mount_options,omitempty"`
+	LUKS          *LUKSConfig            `yaml:"luks,omitempty"`
+	// AllowWipeForeign lets on_initialize and on_fail format a disk that
+	// holds signatures tdx-init did not write.
+	AllowWipeForeign bool `yaml:"allow_wipe_foreign,omitempty"`
+	// Recovery adds a second keyslot whose key is escrowed to operators.
+	Recovery *RecoveryConfig `yaml:"recovery,omitempty"`
+}
+
+// RecoveryConfig lists the X25519 public keys (base64) the recovery key of
+// a disk is encrypted to, one copy per operator.
+type RecoveryConfig struct {
+	OperatorKeys []string `yaml:"operator_keys"`
+}
+
+// LUKSConfig sets the luksFormat encryption options. Unset fields keep the
+// cryptsetup defaults.
+type LUKSConfig struct {
+	Cipher     string `yaml:"cipher,omitempty"`
+	KeySize    int    `yaml:"key_size,omitempty"`
+	SectorSize int    `yaml:"sector_size,omitempty"`
+	Integrity  string `yaml:"integrity,omitempty"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -57,45 +101,151 @@ func (c *Config) Validate() error {
 	if c.SSH.Strategy == "" {
 		return fmt.Errorf("ssh.strategy is required")
 	}
+	if value, ok := c.SSH.StrategyConfig["tls"]; ok {
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("ssh.strategy_config.tls must be true or false")
+		}
+	}
 	if c.SSH.Dir == "" {
 		c.SSH.Dir = "/root/.ssh"
 	}
 	if c.SSH.KeyPath == "" {
 		c.SSH.KeyPath = "/etc/root_key"
 	}
+	if c.SSH.KeyOptions == nil {
+		c.SSH.KeyOptions = []string{"no-port-forwarding", "no-agent-forwarding", "no-X11-forwarding"}
+	}
 
 	for name, key := range c.Keys {
 		if key.Strategy == "" {
 			return fmt.Errorf("keys.%s.strategy is required", name)
 		}
-		if key.Strategy != "random" && key.Strategy != "pipe" {
-			return fmt.Errorf("keys.%s.strategy must be 'random' or 'pipe'", name)
+		switch key.Strategy {
+		case "random", "pipe", "https", "kbs", "shamir":
+		default:
+			return fmt.Errorf("keys.%s.strategy must be 'random', 'pipe', 'https', 'kbs', or 'shamir'", name)
 		}
+		if key.Strategy == "shamir" {
+			if err := validateShamir(name, key.StrategyConfig); err != nil {
+				return err
+			}
+		}
+		if key.Strategy == "https" {
+			if signers, _ := key.StrategyConfig["trusted_signers"].([]interface{}); len(signers) == 0 {
+				return fmt.Errorf("keys.%s.strategy_config.trusted_signers is required for 'https' strategy", name)
+			}
+		}
+		if key.Strategy == "kbs" {
+			url, _ := key.StrategyConfig["url"].(string)
+			if url == "" {
+				return fmt.Errorf("keys.%s.strategy_config.url is required for 'kbs' strategy", name)
+			}
+			if allowHTTP, _ := key.StrategyConfig["allow_insecure_http"].(bool); !allowHTTP && !strings.HasPrefix(url, "https://") {
+				return fmt.Errorf("keys.%s.strategy_config.url must use https, or set allow_insecure_http", name)
+			}
+		}
+		if key.TPMPolicy != nil {
+			if !key.TPM {
+				return fmt.Errorf("keys.%s.tpm_policy requires tpm to be enabled", name)
+			}
+			if len(key.TPMPolicy.PCRs) == 0 {
+				return fmt.Errorf("keys.%s.tpm_policy.pcrs must list at least one PCR", name)
+			}
+			for _, pcr := range key.TPMPolicy.PCRs {
+				if pcr < 0 || pcr > 23 {
+					return fmt.Errorf("keys.%s.tpm_policy.pcrs contains invalid PCR %d", name, pcr)
+				}
+			}
+		}
+	}
+
+	if err := c.allocateNVIndices(); err != nil {
+		return err
 	}
 
 	for name, disk := range c.Disks {
 		if disk.Strategy == "" {
 			return fmt.Errorf("disks.%s.strategy is required", name)
 		}
-		if disk.Strategy != "largest" && disk.Strategy != "pathglob" {
-			return fmt.Errorf("disks.%s.strategy must be 'largest' or 'pathglob'", name)
+		switch disk.Strategy {
+		case "largest", "pathglob":
+		case "identity":
+			if err := validateIdentity(fmt.Sprintf("disks.%s.strategy_config", name), disk.StrategyConfig); err != nil {
+				return err
+			}
+		case "raid":
+			if err := validateRaid(name, disk.StrategyConfig); err != nil {
+				return err
+			}
+			// Without a list every blank disk is claimed, including those
+			// the other disks are meant to find.
+			if _, ok := disk.StrategyConfig["devices"]; !ok && len(c.Disks) > 1 {
+				return fmt.Errorf("disks.%s.strategy_config.devices is required when more than one disk is configured", name)
+			}
+		case "partition":
+			if err := validatePartition(name, disk.StrategyConfig); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("disks.%s.strategy must be 'largest', 'pathglob', 'identity', 'raid', or 'partition'", name)
 		}
 		if disk.Format == "" {
 			disk.Format = "on_initialize"
 		}
-		if disk.Format != "always" && disk.Format != "on_initialize" && disk.Format != "never" && disk.Format != "on_fail" {
-			return fmt.Errorf("disks.%s.format must be 'always', 'on_initialize', 'on_fail', or 'never'", name)
+		if disk.Format != "always" && disk.Format != "on_initialize" && disk.Format != "never" && disk.Format != "on_fail" && disk.Format != "ephemeral" {
+			return fmt.Errorf("disks.%s.format must be 'always', 'on_initialize', 'on_fail', 'never', or 'ephemeral'", name)
+		}
+		if disk.Format == "ephemeral" {
+			if err := validateEphemeral(name, disk); err != nil {
+				return err
+			}
 		}
 		if disk.MountAt == "" {
 			return fmt.Errorf("disks.%s.mount_at is required", name)
 		}
+		if disk.FSType == "" {
+			disk.FSType = "ext4"
+		}
+		if disk.FSType != "ext4" && disk.FSType != "xfs" {
+			return fmt.Errorf("disks.%s.fs_type must be 'ext4' or 'xfs'", name)
+		}
+		for _, option := range disk.MkfsOptions {
+			if strings.TrimSpace(option) == "" {
+				return fmt.Errorf("disks.%s.mkfs_options must not contain empty options", name)
+			}
+		}
+		if disk.LUKS != nil {
+			if disk.EncryptionKey == "" && disk.Format != "ephemeral" {
+				return fmt.Errorf("disks.%s.luks requires encryption_key", name)
+			}
+			if err := validateLUKS(name, disk.LUKS); err != nil {
+				return err
+			}
+		}
+		if disk.Recovery != nil {
+			if disk.EncryptionKey == "" {
+				return fmt.Errorf("disks.%s.recovery requires encryption_key", name)
+			}
+			if err := validateRecovery(name, disk.Recovery); err != nil {
+				return err
+			}
+		}
+		for _, option := range disk.MountOptions {
+			if option == "" || strings.ContainsAny(option, ", \t") {
+				return fmt.Errorf("disks.%s.mount_options entry %q must be a single option without commas or spaces", name, option)
+			}
+		}
 		c.Disks[name] = disk
 	}
 
 	if c.SSH.StoreAt != "" {
-		if _, ok := c.Disks[c.SSH.StoreAt]; !ok {
+		storeAt, ok := c.Disks[c.SSH.StoreAt]
+		if !ok {
 			return fmt.Errorf("ssh.store_at references non-existent disk '%s'", c.SSH.StoreAt)
 		}
+		if storeAt.Format == "ephemeral" {
+			return fmt.Errorf("ssh.store_at references ephemeral disk '%s', which has no LUKS header", c.SSH.StoreAt)
+		}
 	}
 
 	for name, disk := range c.Disks {
@@ -107,4 +257,310 @@ func (c *Config) Validate() error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func validateShamir(name string, cfg map[string]interface{}) error {
+	threshold, ok := cfg["threshold"].(int)
+	if !ok || threshold < 2 {
+		return fmt.Errorf("keys.%s.strategy_config.threshold must be an integer of at least 2", name)
+	}
+
+	operators, _ := cfg["operator_keys"].([]interface{})
+	if len(operators) > 0 && len(operators) < threshold {
+		return fmt.Errorf("keys.%s.strategy_config.operator_keys lists %d keys, fewer than threshold %d", name, len(operators), threshold)
+	}
+	if len(operators) > 255 {
+		return fmt.Errorf("keys.%s.strategy_config.operator_keys lists more than 255 keys", name)
+	}
+
+	pipes, _ := cfg["share_pipes"].([]interface{})
+	server, _ := cfg["share_server"].(string)
+	if len(pipes) == 0 && server == "" {
+		return fmt.Errorf("keys.%s.strategy_config needs share_pipes or share_server", name)
+	}
+
+	return nil
+}
+
+func validateIdentity(path string, cfg map[string]interface{}) error {
+	found := false
+	for _, field := range []string{"wwn", "serial", "by_id", "by_path", "gcp_name"} {
+		if value, ok := cfg[field]; ok {
+			if s, isString := value.(string); !isString || s == "" {
+				return fmt.Errorf("%s.%s must be a non-empty string", path, field)
+			}
+			found = true
+		}
+	}
+	if lun, ok := cfg["azure_lun"]; ok {
+		if n, isInt := lun.(int); !isInt || n < 0 {
+			return fmt.Errorf("%s.azure_lun must be a non-negative integer", path)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("%s needs at least one of wwn, serial, by_id, by_path, azure_lun, or gcp_name", path)
+	}
+	return nil
+}
+
+func validateLUKS(name string, luks *LUKSConfig) error {
+	if luks.KeySize < 0 || luks.KeySize%8 != 0 {
+		return fmt.Errorf("disks.%s.luks.key_size must be a multiple of 8, or 0 for the cryptsetup default", name)
+	}
+
+	switch luks.SectorSize {
+	case 0, 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("disks.%s.luks.sector_size must be 512, 1024, 2048, or 4096", name)
+	}
+
+	// AEAD ciphers authenticate by themselves and need integrity 'aead';
+	// length-preserving ciphers need a separate MAC.
+	aeadCipher := strings.Contains(luks.Cipher, "gcm") || strings.Contains(luks.Cipher, "chacha20")
+	switch luks.Integrity {
+	case "":
+		if aeadCipher {
+			return fmt.Errorf("disks.%s.luks.cipher %s requires integrity 'aead'", name, luks.Cipher)
+		}
+	case "aead":
+		if !aeadCipher {
+			return fmt.Errorf("disks.%s.luks.integrity 'aead' requires an AEAD cipher such as aes-gcm-random", name)
+		}
+	case "hmac-sha256", "hmac-sha512", "poly1305":
+		if aeadCipher {
+			return fmt.Errorf("disks.%s.luks.cipher %s requires integrity 'aead'", name, luks.Cipher)
+		}
+	default:
+		return fmt.Errorf("disks.%s.luks.integrity must be 'aead', 'hmac-sha256', 'hmac-sha512', or 'poly1305'", name)
+	}
+
+	return nil
+}
+
+// validateEphemeral checks a disk that is encrypted with plain dm-crypt
+// under a new key on every boot. There is no key to configure and no LUKS
+// header to keep tokens in.
+func validateEphemeral(name string, disk DiskConfig) error {
+	if disk.EncryptionKey != "" {
+		return fmt.Errorf("disks.%s.encryption_key cannot be used with format 'ephemeral', its key is generated on every boot", name)
+	}
+	if disk.Recovery != nil {
+		return fmt.Errorf("disks.%s.recovery cannot be used with format 'ephemeral'", name)
+	}
+	if disk.LUKS != nil && disk.LUKS.Integrity != "" {
+		return fmt.Errorf("disks.%s.luks.integrity cannot be used with format 'ephemeral'", name)
+	}
+	return nil
+}
+
+func validateRecovery(name string, recovery *RecoveryConfig) error {
+	if len(recovery.OperatorKeys) == 0 {
+		return fmt.Errorf("disks.%s.recovery.operator_keys must list at least one key", name)
+	}
+	for i, key := range recovery.OperatorKeys {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(raw) != 32 {
+			return fmt.Errorf("disks.%s.recovery.operator_keys[%d] must be a base64 X25519 public key", name, i)
+		}
+	}
+	return nil
+}
+
+func validateRaid(name string, cfg map[string]interface{}) error {
+	level := "raid0"
+	if value, ok := cfg["level"]; ok {
+		level, _ = value.(string)
+	}
+	minDevices := 2
+	switch level {
+	case "raid0", "raid1":
+	case "raid10":
+		minDevices = 4
+	default:
+		return fmt.Errorf("disks.%s.strategy_config.level must be 'raid0', 'raid1', or 'raid10'", name)
+	}
+
+	if value, ok := cfg["min_devices"]; ok {
+		n, isInt := value.(int)
+		if !isInt || n < minDevices {
+			return fmt.Errorf("disks.%s.strategy_config.min_devices must be an integer of at least %d for %s", name, minDevices, level)
+		}
+	}
+
+	if value, ok := cfg["devices"]; ok {
+		devices, isList := value.([]interface{})
+		if !isList || len(devices) < minDevices {
+			return fmt.Errorf("disks.%s.strategy_config.devices must list at least %d disks for %s", name, minDevices, level)
+		}
+		for i, device := range devices {
+			identity, isMap := device.(map[string]interface{})
+			if !isMap {
+				return fmt.Errorf("disks.%s.strategy_config.devices[%d] must be a map of disk identifiers", name, i)
+			}
+			if err := validateIdentity(fmt.Sprintf("disks.%s.strategy_config.devices[%d]", name, i), identity); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+var partitionSize = regexp.MustCompile(`^[1-9][0-9]*[KMGT]?$`)
+
+func validatePartition(name string, cfg map[string]interface{}) error {
+	path := fmt.Sprintf("disks.%s.strategy_config", name)
+
+	label, _ := cfg["label"].(string)
+	uuid, _ := cfg["uuid"].(string)
+	for _, field := range []string{"label", "uuid"} {
+		if value, ok := cfg[field]; ok {
+			if s, isString := value.(string); !isString || s == "" {
+				return fmt.Errorf("%s.%s must be a non-empty string", path, field)
+			}
+		}
+	}
+	if label == "" && uuid == "" {
+		return fmt.Errorf("%s needs a partition label or uuid", path)
+	}
+
+	_, hasDisk := cfg["disk"]
+	layoutValue, hasLayout := cfg["layout"]
+	if hasDisk != hasLayout {
+		return fmt.Errorf("%s.disk and %s.layout must be set together", path, path)
+	}
+	if !hasLayout {
+		return nil
+	}
+
+	diskCfg, isMap := cfg["disk"].(map[string]interface{})
+	if !isMap {
+		return fmt.Errorf("%s.disk must be a map with a strategy", path)
+	}
+	switch diskCfg["strategy"] {
+	case "largest", "pathglob":
+	case "identity":
+		identity, _ := diskCfg["strategy_config"].(map[string]interface{})
+		if err := validateIdentity(path+".disk.strategy_config", identity); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s.disk.strategy must be 'largest', 'pathglob', or 'identity'", path)
+	}
+
+	if label == "" {
+		return fmt.Errorf("%s.layout requires a label to find the created partition", path)
+	}
+	layout, isList := layoutValue.([]interface{})
+	if !isList || len(layout) == 0 {
+		return fmt.Errorf("%s.layout must list at least one partition", path)
+	}
+	labels := make(map[string]bool)
+	for i, entry := range layout {
+		spec, isMap := entry.(map[string]interface{})
+		if !isMap {
+			return fmt.Errorf("%s.layout[%d] must be a map with label and size", path, i)
+		}
+		specLabel, _ := spec["label"].(string)
+		if specLabel == "" || len(specLabel) > 36 {
+			return fmt.Errorf("%s.layout[%d].label must be 1 to 36 characters", path, i)
+		}
+		if labels[specLabel] {
+			return fmt.Errorf("%s.layout lists label %s twice", path, specLabel)
+		}
+		labels[specLabel] = true
+		size, hasSize := spec["size"]
+		if !hasSize && i != len(layout)-1 {
+			return fmt.Errorf("%s.layout[%d].size is required, only the last partition may take the rest of the disk", path, i)
+		}
+		if hasSize && !partitionSize.MatchString(fmt.Sprint(size)) {
+			return fmt.Errorf("%s.layout[%d].size must be a number of sectors or a size such as 512M or 1G", path, i)
+		}
+	}
+	if !labels[label] {
+		return fmt.Errorf("%s.layout does not contain partition %s", path, label)
+	}
+
+	return nil
+}
+
+// allocateNVIndices gives every TPM-backed key without nv_index an index
+// derived from its name, so it does not move when other keys are added,
+// removed or renamed, and rejects keys whose indices collide.
+func (c *Config) allocateNVIndices() error {
+	names := make([]string, 0, len(c.Keys))
+	for name := range c.Keys {
+		if c.Keys[name].TPM || c.Keys[name].NVIndex != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	used := make(map[uint32]string)
+	for _, name := range names {
+		key := c.Keys[name]
+		if !key.TPM {
+			return fmt.Errorf("keys.%s.nv_index requires tpm to be enabled", name)
+		}
+
+		var index uint32
+		if key.NVIndex == "" {
+			index = derivedNVIndex(name)
+			// Before per-key indices the only TPM-backed key lived at
+			// tpm.DefaultNVIndex; it is moved from there on first use.
+			if len(names) == 1 && index != tpm.DefaultNVIndex {
+				key.LegacyNVIndex = fmt.Sprintf("0x%x", tpm.DefaultNVIndex)
+			}
+		} else {
+			var err error
+			index, err = ParseNVIndex(key.NVIndex)
+			if err != nil {
+				return fmt.Errorf("keys.%s.nv_index: %w", name, err)
+			}
+		}
+
+		if other, ok := used[index]; ok {
+			return fmt.Errorf("keys.%s TPM NV index 0x%x collides with keys.%s; set nv_index on one of them", name, index, other)
+		}
+		// ScratchIndex is its own inverse, so this also catches an earlier
+		// key whose scratch index is this one.
+		if other, ok := used[tpm.ScratchIndex(index)]; ok {
+			return fmt.Errorf("keys.%s TPM NV index 0x%x is the scratch index of keys.%s; set nv_index on one of them", name, index, other)
+		}
+		used[index] = name
+		key.NVIndex = fmt.Sprintf("0x%x", index)
+		c.Keys[name] = key
+	}
+
+	return nil
+}
+
+// derivedNVIndexBase is the start of the 64Ki indices keys without nv_index
+// are placed in.
+const derivedNVIndexBase uint32 = 0x01510000
+
+// derivedNVIndex maps a key name into the derived index range with FNV-1a.
+func derivedNVIndex(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return derivedNVIndexBase | h.Sum32()&0xffff
+}
+
+const (
+	minNVIndex uint32 = 0x01000000
+	maxNVIndex uint32 = 0x01ffffff
+)
+
+// ParseNVIndex parses a TPM NV index such as "0x1500016" and checks that it
+// lies in the NV index handle range.
+func ParseNVIndex(s string) (uint32, error) {
+	index, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid NV index %q: %w", s, err)
+	}
+	if uint32(index) < minNVIndex || uint32(index) > maxNVIndex {
+		return 0, fmt.Errorf("NV index %q is outside the range 0x%x-0x%x", s, minNVIndex, maxNVIndex)
+	}
+	return uint32(index), nil
+}
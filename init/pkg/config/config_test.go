@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func tpmKeysConfig(keys map[string]KeyConfig) *Config {
+	return &Config{
+		SSH:  SSHConfig{Strategy: "webserver"},
+		Keys: keys,
+	}
+}
+
+func TestNVIndicesDoNotMoveWhenKeysAreAdded(t *testing.T) {
+	lone := tpmKeysConfig(map[string]KeyConfig{
+		"key_persistent": {Strategy: "random", TPM: true},
+	})
+	if err := lone.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	index := lone.Keys["key_persistent"].NVIndex
+	if got := lone.Keys["key_persistent"].LegacyNVIndex; got != "0x1500016" {
+		t.Fatalf("lone key legacy index = %q, want 0x1500016", got)
+	}
+
+	several := tpmKeysConfig(map[string]KeyConfig{
+		"key_persistent": {Strategy: "random", TPM: true},
+		"a_key":          {Strategy: "random", TPM: true},
+		"z_key":          {Strategy: "random", TPM: true},
+	})
+	if err := several.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if got := several.Keys["key_persistent"].NVIndex; got != index {
+		t.Fatalf("index moved from %s to %s when keys were added", index, got)
+	}
+	for name, key := range several.Keys {
+		if key.LegacyNVIndex != "" {
+			t.Fatalf("keys.%s got legacy index %s alongside other TPM keys", name, key.LegacyNVIndex)
+		}
+	}
+}
+
+func TestNVIndexCollisions(t *testing.T) {
+	derived := fmt.Sprintf("0x%x", derivedNVIndex("key_a"))
+	tests := []struct {
+		name string
+		keys map[string]KeyConfig
+		want string
+	}{
+		{"explicit", map[string]KeyConfig{
+			"key_a": {Strategy: "random", TPM: true, NVIndex: "0x1500020"},
+			"key_b": {Strategy: "random", TPM: true, NVIndex: "0x1500020"},
+		}, "collides with keys.key_a"},
+		{"explicit on derived", map[string]KeyConfig{
+			"key_a": {Strategy: "random", TPM: true},
+			"key_b": {Strategy: "random", TPM: true, NVIndex: derived},
+		}, "collides with keys.key_a"},
+		{"scratch", map[string]KeyConfig{
+			"key_a": {Strategy: "random", TPM: true, NVIndex: "0x1500020"},
+			"key_b": {Strategy: "random", TPM: true, NVIndex: "0x1d00020"},
+		}, "scratch index of keys.key_a"},
+		{"without tpm", map[string]KeyConfig{
+			"key_a": {Strategy: "random", NVIndex: "0x1500020"},
+		}, "requires tpm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tpmKeysConfig(tt.keys).Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Validate = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package disks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BlockOps is everything the Manager does to block devices, LUKS headers and
+// filesystems. ExecBlockOps runs the system tools; the tests' FakeBlockOps
+// keeps state in memory so the Manager's decisions can be exercised without
+// root.
+type BlockOps interface {
+	IsLuks(device string) bool
+	LuksFormat(device, passphrase string, args []string) error
+	LuksOpen(device, mapperName, passphrase string) error
+	LuksClose(mapperName string) error
+	// PlainOpen maps device with plain dm-crypt, which keeps no header, so
+	// the data is only readable with the same key and args.
+	PlainOpen(device, mapperName string, key []byte, args []string) error
+	LuksStatus(mapperName string) (LuksStatus, error)
+	LuksResize(mapperName, passphrase string) error
+	LuksParams(device string) (LuksParams, error)
+	// LuksLabel returns the label in the LUKS2 header, "" if none is set.
+	LuksLabel(device string) (string, error)
+	// LuksAddKey adds a keyslot for newPassphrase, unlocked by passphrase.
+	LuksAddKey(device, passphrase, newPassphrase string) error
+	// LuksRemoveKey removes the keyslot that passphrase opens.
+	LuksRemoveKey(device, passphrase string) error
+	// LuksKeyslots lists the keyslots in use.
+	LuksKeyslots(device string) ([]int, error)
+	// LuksKeyslot returns the keyslot that passphrase opens.
+	LuksKeyslot(device, passphrase string) (int, error)
+	// LuksKillSlot removes a keyslot, authorized by the passphrase of
+	// another one.
+	LuksKillSlot(device string, slot int, passphrase string) error
+	ExportToken(device, tokenID string) (*Token, error)
+	// ImportToken stores token under tokenID, replacing any existing one.
+	ImportToken(device, tokenID string, token *Token) error
+
+	Mkfs(device, fsType string, options []string) error
+	// FilesystemType returns "" if device has no filesystem.
+	FilesystemType(device string) string
+	// FilesystemSize returns the size and block size of the filesystem on
+	// device, which is mounted at mountPoint.
+	FilesystemSize(device, mountPoint, fsType string) (int64, int64, error)
+	GrowFilesystem(device, mountPoint, fsType string) error
+	Mount(device, mountPoint, fsType string, options []string) error
+	Unmount(mountPoint string) error
+	IsMounted(mountPoint string) bool
+
+	// DeviceSize returns the size of a block device in bytes.
+	DeviceSize(device string) (int64, error)
+	// Signatures lists the filesystem, partition table and other
+	// signatures found on device, e.g. "gpt at 0x200"; none if it is blank.
+	Signatures(device string) ([]string, error)
+}
+
+// LuksStatus describes an open mapping. Offset and Size are in bytes.
+type LuksStatus struct {
+	Device string
+	Offset int64
+	Size   int64
+}
+
+// ExecBlockOps implements BlockOps with cryptsetup, mkfs, mount and friends.
+type ExecBlockOps struct{}
+
+func NewExecBlockOps() *ExecBlockOps {
+	return &ExecBlockOps{}
+}
+
+func (e *ExecBlockOps) IsLuks(device string) bool {
+	return exec.Command("cryptsetup", "isLuks", device).Run() == nil
+}
+
+func (e *ExecBlockOps) LuksFormat(device, passphrase string, args []string) error {
+	args = append([]string{"luksFormat", "--type", "luks2", "-q"}, args...)
+	cmd := exec.Command("cryptsetup", append(args, device)...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to format with LUKS: %w", err)
+	}
+	return nil
+}
+
+func (e *ExecBlockOps) LuksOpen(device, mapperName, passphrase string) error {
+	cmd := exec.Command("cryptsetup", "open", device, mapperName)
+	cmd.Stdin = strings.NewReader(passphrase)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to open LUKS device: %w", err)
+	}
+	return nil
+}
+
+// PlainOpen names stdin by path: with --key-file - cryptsetup treats the
+// input as a passphrase and hashes it, while a key file is used as the raw
+// key. --keyfile-size stops it reading past the key.
+func (e *ExecBlockOps) PlainOpen(device, mapperName string, key []byte, args []string) error {
+	args = append([]string{"open", "--type", "plain",
+		"--key-file", "/dev/stdin", "--keyfile-size", strconv.Itoa(len(key))}, args...)
+	cmd := exec.Command("cryptsetup", append(args, device, mapperName)...)
+	cmd.Stdin = bytes.NewReader(key)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to open plain dm-crypt device: %w", err)
+	}
+	return nil
+}
+
+func (e *ExecBlockOps) LuksClose(mapperName string) error {
+	return exec.Command("cryptsetup", "close", mapperName).Run()
+}
+
+func (e *ExecBlockOps) LuksStatus(mapperName string) (LuksStatus, error) {
+	output, err := exec.Command("cryptsetup", "status", mapperName).Output()
+	if err != nil {
+		return LuksStatus{}, fmt.Errorf("mapping %s is not active", mapperName)
+	}
+
+	var status LuksStatus
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "device:":
+			status.Device = fields[1]
+		case "offset:":
+			sectors, _ := strconv.ParseInt(fields[1], 10, 64)
+			status.Offset = sectors * 512
+		case "size:":
+			sectors, _ := strconv.ParseInt(fields[1], 10, 64)
+			status.Size = sectors * 512
+		}
+	}
+	if status.Device == "" || status.Size == 0 {
+		return LuksStatus{}, fmt.Errorf("incomplete status of %s", mapperName)
+	}
+	return status, nil
+}
+
+// LuksResize needs the passphrase because LUKS2 keeps the volume key in the
+// kernel keyring.
+func (e *ExecBlockOps) LuksResize(mapperName, passphrase string) error {
+	cmd := exec.Command("cryptsetup", "resize", mapperName)
+	cmd.Stdin = strings.NewReader(passphrase)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to resize LUKS mapping: %w", err)
+	}
+	return nil
+}
+
+func (e *ExecBlockOps) LuksParams(device string) (LuksParams, error) {
+	output, err := exec.Command("cryptsetup", "luksDump", "--dump-json-metadata", device).Output()
+	if err != nil {
+		return LuksParams{}, fmt.Errorf("failed to dump LUKS header: %w", err)
+	}
+
+	var metadata struct {
+		Keyslots map[string]struct {
+			KeySize int `json:"key_size"`
+		} `json:"keyslots"`
+		Segments map[string]struct {
+			Encryption string `json:"encryption"`
+			SectorSize int    `json:"sector_size"`
+			Integrity  *struct {
+				Type string `json:"type"`
+			} `json:"integrity"`
+		} `json:"segments"`
+	}
+	if err := json.Unmarshal(output, &metadata); err != nil {
+		return LuksParams{}, fmt.Errorf("failed to parse LUKS header: %w", err)
+	}
+
+	segment, ok := metadata.Segments["0"]
+	if !ok {
+		return LuksParams{}, fmt.Errorf("LUKS header has no data segment")
+	}
+
+	params := LuksParams{
+		Cipher:     segment.Encryption,
+		SectorSize: segment.SectorSize,
+	}
+	if segment.Integrity != nil {
+		// The header spells hmac-sha256 as hmac(sha256)
+		params.Integrity = strings.NewReplacer("(", "-", ")", "").Replace(segment.Integrity.Type)
+	}
+	for _, keyslot := range metadata.Keyslots {
+		params.KeySize = keyslot.KeySize * 8
+		break
+	}
+
+	return params, nil
+}
+
+func (e *ExecBlockOps) LuksLabel(device string) (string, error) {
+	output, err := exec.Command("cryptsetup", "luksDump", device).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to dump LUKS header: %w", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if label, ok := strings.CutPrefix(line, "Label:"); ok {
+			label = strings.TrimSpace(label)
+			if label == "(no label)" {
+				return "", nil
+			}
+			return label, nil
+		}
+	}
+	return "", nil
+}
+
+// LuksAddKey passes each passphrase as a key file on its own descriptor.
+// A key file is read in full, so both are first cut as cryptsetup cuts a
+// passphrase on stdin, and the new keyslot accepts what LuksOpen passes.
+func (e *ExecBlockOps) LuksAddKey(device, passphrase, newPassphrase string) error {
+	cmd := exec.Command("cryptsetup", "luksAddKey", "--key-file", "/dev/fd/3", device, "/dev/fd/4")
+	if err := runWithKeyFiles(cmd, stdinPassphrase(passphrase), stdinPassphrase(newPassphrase)); err != nil {
+		return fmt.Errorf("failed to add LUKS key: %w", err)
+	}
+	return nil
+}
+
+// stdinPassphrase returns what cryptsetup takes from a passphrase given on
+// stdin, which it reads up to the first newline.
+func stdinPassphrase(passphrase string) string {
+	line, _, _ := strings.Cut(passphrase, "\n")
+	return line
+}
+
+// runWithKeyFiles runs cmd with each key readable from a pipe, the first
+// on /dev/fd/3.
+func runWithKeyFiles(cmd *exec.Cmd, keys ...string) error {
+	writers := make([]*os.File, len(keys))
+	for i := range keys {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeAll(cmd.ExtraFiles)
+			closeAll(writers[:i])
+			return fmt.Errorf("failed to create pipe: %w", err)
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		writers[i] = w
+	}
+
+	err := cmd.Start()
+	// The child holds its own copies of the read ends
+	closeAll(cmd.ExtraFiles)
+	if err != nil {
+		closeAll(writers)
+		return err
+	}
+
+	// Each key is written from its own goroutine, as cryptsetup reads the
+	// key files one after the other.
+	for i, key := range keys {
+		go func(w *os.File, key string) {
+			w.WriteString(key)
+			w.Close()
+		}(writers[i], key)
+	}
+	return cmd.Wait()
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func (e *ExecBlockOps) LuksRemoveKey(device, passphrase string) error {
+	cmd := exec.Command("cryptsetup", "luksRemoveKey", device)
+	cmd.Stdin = strings.NewReader(passphrase)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to remove LUKS key: %w", err)
+	}
+	return nil
+}
+
+func (e *ExecBlockOps) LuksKeyslots(device string) ([]int, error) {
+	output, err := exec.Command("cryptsetup", "luksDump", "--dump-json-metadata", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump LUKS header: %w", err)
+	}
+
+	var metadata struct {
+		Keyslots map[string]json.RawMessage `json:"keyslots"`
+	}
+	if err := json.Unmarshal(output, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse LUKS header: %w", err)
+	}
+
+	slots := make([]int, 0, len(metadata.Keyslots))
+	for id := range metadata.Keyslots {
+		slot, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyslot %q in LUKS header", id)
+		}
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots, nil
+}
+
+// LuksKeyslot parses the "Key slot N unlocked." line cryptsetup prints in
+// verbose mode.
+func (e *ExecBlockOps) LuksKeyslot(device, passphrase string) (int, error) {
+	cmd := exec.Command("cryptsetup", "open", "--test-passphrase", "--verbose", device)
+	cmd.Stdin = strings.NewReader(passphrase)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return -1, fmt.Errorf("no keyslot of %s accepts the passphrase: %w", device, err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		var slot int
+		if _, err := fmt.Sscanf(line, "Key slot %d unlocked.", &slot); err == nil {
+			return slot, nil
+		}
+	}
+	return -1, fmt.Errorf("cryptsetup did not report the keyslot of %s", device)
+}
+
+func (e *ExecBlockOps) LuksKillSlot(device string, slot int, passphrase string) error {
+	cmd := exec.Command("cryptsetup", "luksKillSlot", device, strconv.Itoa(slot))
+	cmd.Stdin = strings.NewReader(passphrase)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to remove LUKS keyslot %d: %w", slot, err)
+	}
+	return nil
+}
+
+func (e *ExecBlockOps) ExportToken(device, tokenID string) (*Token, error) {
+	output, err := exec.Command("cryptsetup", "token", "export", "--token-id", tokenID, device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("no token %s on %s", tokenID, device)
+	}
+
+	var token Token
+	if err := json.Unmarshal(output, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token %s: %w", tokenID, err)
+	}
+	return &token, nil
+}
+
+func (e *ExecBlockOps) ImportToken(device, tokenID string, token *Token) error {
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token %s: %w", tokenID, err)
+	}
+
+	cmd := exec.Command("cryptsetup", "token", "import", "--token-id", tokenID, "--token-replace", device)
+	cmd.Stdin = strings.NewReader(string(tokenJSON))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to import token %s: %w", tokenID, err)
+	}
+	return nil
+}
+
+// Mkfs passes options before the device argument. The caller has already
+// decided to format, so existing signatures are overwritten.
+func (e *ExecBlockOps) Mkfs(device, fsType string, options []string) error {
+	args := append([]string{}, options...)
+	if fsType == "xfs" {
+		args = append(args, "-f")
+	}
+	args = append(args, device)
+
+	if output, err := exec.Command("mkfs."+fsType, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create filesystem: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+func (e *ExecBlockOps) FilesystemType(device string) string {
+	output, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", device).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func (e *ExecBlockOps) FilesystemSize(device, mountPoint, fsType string) (int64, int64, error) {
+	switch fsType {
+	case "ext4":
+		return ext4Size(device)
+	case "xfs":
+		return xfsSize(mountPoint)
+	default:
+		return 0, 0, fmt.Errorf("sizing %s filesystems is not supported", fsType)
+	}
+}
+
+func (e *ExecBlockOps) GrowFilesystem(device, mountPoint, fsType string) error {
+	cmd := exec.Command("resize2fs", device)
+	if fsType == "xfs" {
+		cmd = exec.Command("xfs_growfs", mountPoint)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to grow filesystem: %w", err)
+	}
+	return nil
+}
+
+func (e *ExecBlockOps) Mount(device, mountPoint, fsType string, options []string) error {
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+
+	var args []string
+	if fsType != "" {
+		args = append(args, "-t", fsType)
+	}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, device, mountPoint)
+
+	if err := exec.Command("mount", args...).Run(); err != nil {
+		return fmt.Errorf("failed to mount device: %w", err)
+	}
+	return nil
+}
+
+func (e *ExecBlockOps) Unmount(mountPoint string) error {
+	return exec.Command("umount", mountPoint).Run()
+}
+
+func (e *ExecBlockOps) IsMounted(mountPoint string) bool {
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(data), " "+mountPoint+" ")
+}
+
+func (e *ExecBlockOps) DeviceSize(device string) (int64, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %s: %w", device, err)
+	}
+
+	// sysfs sizes are in 512-byte sectors regardless of the block size
+	data, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(resolved), "size"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read size of %s: %w", device, err)
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size of %s: %w", device, err)
+	}
+	return sectors * 512, nil
+}
+
+// Signatures lists what wipefs finds, without erasing anything. LUKS is
+// reported with its header version, since only LUKS2 can be tdx-init's.
+func (e *ExecBlockOps) Signatures(device string) ([]string, error) {
+	output, err := exec.Command("wipefs", "--noheadings", "--output", "TYPE,OFFSET", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe %s: %w", device, err)
+	}
+
+	var signatures []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		sigType := fields[0]
+		if sigType == "crypto_LUKS" {
+			sigType = luksVersion(device)
+		}
+		signatures = append(signatures, fmt.Sprintf("%s at %s", sigType, fields[1]))
+	}
+	return signatures, nil
+}
+
+// luksVersion reads the big-endian version that follows the 6-byte magic
+// of a LUKS header.
+func luksVersion(device string) string {
+	f, err := os.Open(device)
+	if err != nil {
+		return "LUKS"
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "LUKS"
+	}
+	return fmt.Sprintf("LUKS%d", binary.BigEndian.Uint16(header[6:8]))
+}
+
+func ext4Size(device string) (int64, int64, error) {
+	output, err := exec.Command("dumpe2fs", "-h", device).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read filesystem superblock: %w", err)
+	}
+
+	var blockCount, blockSize int64
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Block count":
+			blockCount, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		case "Block size":
+			blockSize, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	if blockCount == 0 || blockSize == 0 {
+		return 0, 0, fmt.Errorf("no block count in superblock of %s", device)
+	}
+	return blockCount * blockSize, blockSize, nil
+}
+
+// xfsSize parses the data section of xfs_info, e.g.
+// "data     =        bsize=4096   blocks=262144, imaxpct=25".
+func xfsSize(mountPoint string) (int64, int64, error) {
+	output, err := exec.Command("xfs_info", mountPoint).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read filesystem geometry: %w", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "data") {
+			continue
+		}
+		var blockCount, blockSize int64
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if value, ok := strings.CutPrefix(field, "bsize="); ok {
+				blockSize, _ = strconv.ParseInt(value, 10, 64)
+			}
+			if value, ok := strings.CutPrefix(field, "blocks="); ok {
+				blockCount, _ = strconv.ParseInt(value, 10, 64)
+			}
+		}
+		if blockCount > 0 && blockSize > 0 {
+			return blockCount * blockSize, blockSize, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("no data section in geometry of %s", mountPoint)
+}
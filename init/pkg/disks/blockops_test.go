@@ -0,0 +1,33 @@
+package disks
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+)
+
+func TestRunWithKeyFiles(t *testing.T) {
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", "cat /dev/fd/3; printf '|'; cat /dev/fd/4")
+	cmd.Stdout = &out
+	if err := runWithKeyFiles(cmd, "old key", string(bytes.Repeat([]byte("n"), 1<<17))); err != nil {
+		t.Fatalf("runWithKeyFiles: %v", err)
+	}
+	if want := "old key|" + string(bytes.Repeat([]byte("n"), 1<<17)); out.String() != want {
+		t.Fatalf("command read %d bytes, want %d", out.Len(), len(want))
+	}
+}
+
+func TestStdinPassphrase(t *testing.T) {
+	tests := map[string]string{
+		"secret":          "secret",
+		"secret\n":        "secret",
+		"secret\nignored": "secret",
+		"":                "",
+	}
+	for in, want := range tests {
+		if got := stdinPassphrase(in); got != want {
+			t.Errorf("stdinPassphrase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package disks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+)
+
+// LuksParams are the encryption settings of a LUKS2 data segment. KeySize
+// is in bits and includes the integrity key when there is one. Integrity
+// uses cryptsetup's --integrity spelling, e.g. "hmac-sha256" or "aead".
+type LuksParams struct {
+	Cipher     string
+	KeySize    int
+	SectorSize int
+	Integrity  string
+}
+
+// luksFormatArgs turns the disk's luks settings into luksFormat flags.
+// Unset fields keep the cryptsetup defaults.
+func luksFormatArgs(luks *config.LUKSConfig) []string {
+	if luks == nil {
+		return nil
+	}
+
+	var args []string
+	if luks.Cipher != "" {
+		args = append(args, "--cipher", luks.Cipher)
+	}
+	if luks.KeySize != 0 {
+		args = append(args, "--key-size", strconv.Itoa(luks.KeySize))
+	}
+	if luks.SectorSize != 0 {
+		args = append(args, "--sector-size", strconv.Itoa(luks.SectorSize))
+	}
+	if luks.Integrity != "" {
+		args = append(args, "--integrity", luks.Integrity)
+	}
+	return args
+}
+
+// Mismatch reports how the header settings actual differ from the settings
+// p recorded at format time, or "" if they do not.
+func (p LuksParams) Mismatch(actual LuksParams) string {
+	var diffs []string
+	if p.Cipher != "" && actual.Cipher != "" && p.Cipher != actual.Cipher {
+		diffs = append(diffs, fmt.Sprintf("cipher %s, recorded %s", actual.Cipher, p.Cipher))
+	}
+	if p.KeySize != 0 && actual.KeySize != 0 && p.KeySize != actual.KeySize {
+		diffs = append(diffs, fmt.Sprintf("key size %d, recorded %d", actual.KeySize, p.KeySize))
+	}
+	if p.SectorSize != 0 && actual.SectorSize != 0 && p.SectorSize != actual.SectorSize {
+		diffs = append(diffs, fmt.Sprintf("sector size %d, recorded %d", actual.SectorSize, p.SectorSize))
+	}
+	// Integrity is compared even when absent on one side, since losing it
+	// is the downgrade to detect. Tokens without a cipher predate recording.
+	if p.Cipher != "" && p.Integrity != actual.Integrity {
+		diffs = append(diffs, fmt.Sprintf("integrity %q, recorded %q", actual.Integrity, p.Integrity))
+	}
+	return strings.Join(diffs, "; ")
+}
+
+// Differs reports which configured settings the header settings p lack.
+// Unset settings are not compared.
+func (p LuksParams) Differs(luks *config.LUKSConfig) string {
+	if luks == nil {
+		return ""
+	}
+
+	var diffs []string
+	if luks.Cipher != "" && luks.Cipher != p.Cipher {
+		diffs = append(diffs, fmt.Sprintf("cipher %s instead of %s", p.Cipher, luks.Cipher))
+	}
+	if luks.SectorSize != 0 && luks.SectorSize != p.SectorSize {
+		diffs = append(diffs, fmt.Sprintf("sector size %d instead of %d", p.SectorSize, luks.SectorSize))
+	}
+	if luks.Integrity != "" && luks.Integrity != p.Integrity {
+		diffs = append(diffs, fmt.Sprintf("integrity %q instead of %q", p.Integrity, luks.Integrity))
+	}
+	return strings.Join(diffs, "; ")
+}
+
+func (p LuksParams) tokenData() map[string]string {
+	data := map[string]string{}
+	if p.Cipher != "" {
+		data["cipher"] = p.Cipher
+	}
+	if p.KeySize != 0 {
+		data["key_size"] = strconv.Itoa(p.KeySize)
+	}
+	if p.SectorSize != 0 {
+		data["sector_size"] = strconv.Itoa(p.SectorSize)
+	}
+	if p.Integrity != "" {
+		data["integrity"] = p.Integrity
+	}
+	return data
+}
+
+func luksParamsFromToken(data map[string]string) LuksParams {
+	keySize, _ := strconv.Atoi(data["key_size"])
+	sectorSize, _ := strconv.Atoi(data["sector_size"])
+	return LuksParams{
+		Cipher:     data["cipher"],
+		KeySize:    keySize,
+		SectorSize: sectorSize,
+		Integrity:  data["integrity"],
+	}
+}
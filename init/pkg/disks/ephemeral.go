@@ -0,0 +1,103 @@
+package disks
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+)
+
+// Plain dm-crypt keeps no header recording its settings, so they are always
+// passed rather than left to cryptsetup's plain mode defaults, whose 256-bit
+// key means AES-128 in XTS mode.
+const (
+	ephemeralCipher  = "aes-xts-plain64"
+	ephemeralKeySize = 512
+)
+
+// ephemeralMountOptions are added to mount_options, as for a tmpfs.
+var ephemeralMountOptions = []string{"nodev", "nosuid"}
+
+// setupEphemeral encrypts the disk with plain dm-crypt under a key that
+// only exists in memory during this boot, then creates and mounts a new
+// filesystem. Whatever the disk held before is unreadable from then on.
+func (dm *Manager) setupEphemeral(disk *ManagedDisk) error {
+	// Already set up in this boot, e.g. by an earlier setup run
+	if status, err := dm.ops.LuksStatus(disk.MapperName); err == nil && status.Device == disk.DevicePath {
+		log.Printf("Ephemeral disk %s is already open", disk.Name)
+		return dm.mountEphemeral(disk)
+	}
+
+	if err := dm.checkWipe(disk); err != nil {
+		return err
+	}
+
+	cipher, keySize := ephemeralSettings(disk.Config.LUKS)
+	key := make([]byte, keySize/8)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate one-time key: %w", err)
+	}
+
+	log.Printf("Encrypting %s with plain dm-crypt (%s) under a one-time key", disk.DevicePath, cipher)
+	err := dm.ops.PlainOpen(disk.DevicePath, disk.MapperName, key, plainArgs(disk.Config.LUKS))
+	clear(key)
+	if err != nil {
+		return err
+	}
+
+	if err := dm.createFilesystem(disk, disk.MapperDevice); err != nil {
+		dm.ops.LuksClose(disk.MapperName)
+		return err
+	}
+
+	if err := dm.mountEphemeral(disk); err != nil {
+		dm.ops.LuksClose(disk.MapperName)
+		return err
+	}
+
+	if err := CreateMountDirs(disk.Config.MountAt, []string{"data", "logs"}); err != nil {
+		log.Printf("Warning: Failed to create subdirectories: %v", err)
+	}
+
+	disk.Initialized = true
+	log.Printf("Successfully set up ephemeral disk %s", disk.Name)
+	return nil
+}
+
+func (dm *Manager) mountEphemeral(disk *ManagedDisk) error {
+	if dm.ops.IsMounted(disk.Config.MountAt) {
+		log.Printf("Device already mounted at %s", disk.Config.MountAt)
+		return nil
+	}
+
+	options := append(append([]string{}, ephemeralMountOptions...), disk.Config.MountOptions...)
+	if err := dm.ops.Mount(disk.MapperDevice, disk.Config.MountAt, disk.Config.FSType, options); err != nil {
+		return fmt.Errorf("failed to mount: %w", err)
+	}
+	return nil
+}
+
+func ephemeralSettings(luks *config.LUKSConfig) (string, int) {
+	cipher, keySize := ephemeralCipher, ephemeralKeySize
+	if luks != nil && luks.Cipher != "" {
+		cipher = luks.Cipher
+	}
+	if luks != nil && luks.KeySize != 0 {
+		keySize = luks.KeySize
+	}
+	return cipher, keySize
+}
+
+// plainArgs turns the disk's luks settings into plain mode flags. The key
+// size must match the one-time key, which PlainOpen passes as a key file
+// and so is used unhashed.
+func plainArgs(luks *config.LUKSConfig) []string {
+	cipher, keySize := ephemeralSettings(luks)
+	args := []string{"--cipher", cipher, "--key-size", strconv.Itoa(keySize)}
+	if luks != nil && luks.SectorSize != 0 {
+		args = append(args, "--sector-size", strconv.Itoa(luks.SectorSize))
+	}
+	return args
+}
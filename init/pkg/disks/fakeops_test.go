@@ -0,0 +1,568 @@
+package disks
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+)
+
+// fakeLuksOffset is where the data segment starts, as with the 16 MiB
+// LUKS2 header cryptsetup writes by default.
+const fakeLuksOffset = 16 << 20
+
+// FakeBlockOps implements BlockOps in memory. Devices are addressed by
+// path; an open mapping is addressed as /dev/mapper/<name> and exposes the
+// filesystem inside its LUKS device. Every call is appended to Calls, and
+// an error set in FailOn for a method name is returned by that method.
+type FakeBlockOps struct {
+	Devices map[string]*FakeDevice
+	// Disks maps disk names to device paths for Finder.
+	Disks  map[string]string
+	Mounts map[string]string
+	Calls  []string
+	FailOn map[string]error
+	// CrashAfter, when positive, makes every call after that many calls
+	// fail without effect, as if power was lost. See Reboot.
+	CrashAfter int
+
+	mappings map[string]string
+}
+
+// FakeDevice is a block device. For a LUKS device FS is the filesystem
+// inside the encrypted segment.
+type FakeDevice struct {
+	Size int64
+	Luks bool
+	// Keyslots holds the passphrase of each slot; "" marks a free slot.
+	Keyslots []string
+	Params   LuksParams
+	Label    string
+	// Plain is set while the device holds plain dm-crypt data, which is
+	// indistinguishable from random bytes without the key.
+	Plain      bool
+	Tokens     map[string]*Token
+	FS         *FakeFS
+	MappedSize int64
+	// Foreign lists signatures not modelled otherwise, e.g. "gpt at 0x200".
+	// Formatting clears them.
+	Foreign []string
+}
+
+type FakeFS struct {
+	Type string
+	Size int64
+}
+
+func NewFakeBlockOps() *FakeBlockOps {
+	return &FakeBlockOps{
+		Devices:  make(map[string]*FakeDevice),
+		Disks:    make(map[string]string),
+		Mounts:   make(map[string]string),
+		FailOn:   make(map[string]error),
+		mappings: make(map[string]string),
+	}
+}
+
+// AddDisk adds a blank device and makes it the device found for disk name.
+func (f *FakeBlockOps) AddDisk(name, device string, size int64) *FakeDevice {
+	dev := &FakeDevice{Size: size, Tokens: make(map[string]*Token)}
+	f.Devices[device] = dev
+	f.Disks[name] = device
+	return dev
+}
+
+// Finder is a FinderFunc returning the device registered with AddDisk.
+func (f *FakeBlockOps) Finder(name string, cfg config.DiskConfig) (DiskFinder, error) {
+	return fakeFinder{device: f.Disks[name], name: name}, nil
+}
+
+type fakeFinder struct {
+	device string
+	name   string
+}
+
+func (ff fakeFinder) Find() (string, error) {
+	if ff.device == "" {
+		return "", fmt.Errorf("no disk found for %s", ff.name)
+	}
+	return ff.device, nil
+}
+
+func (f *FakeBlockOps) call(method string, args ...string) error {
+	f.Calls = append(f.Calls, strings.TrimSpace(method+" "+strings.Join(args, " ")))
+	if f.CrashAfter > 0 && len(f.Calls) > f.CrashAfter {
+		return errFakeCrash
+	}
+	return f.FailOn[method]
+}
+
+var errFakeCrash = errors.New("simulated crash")
+
+// Reboot drops what does not survive a crash or power loss, open mappings
+// and mounts, and ends a crash set up with CrashAfter. Devices keep their
+// contents.
+func (f *FakeBlockOps) Reboot() {
+	f.mappings = make(map[string]string)
+	f.Mounts = make(map[string]string)
+	f.CrashAfter = 0
+}
+
+func (f *FakeBlockOps) device(device string) (*FakeDevice, error) {
+	dev, ok := f.Devices[device]
+	if !ok {
+		return nil, fmt.Errorf("no such device %s", device)
+	}
+	return dev, nil
+}
+
+// open resolves a path that holds a filesystem: either a plain device or
+// an open mapping.
+func (f *FakeBlockOps) open(device string) (*FakeDevice, int64, error) {
+	if mapperName, ok := strings.CutPrefix(device, "/dev/mapper/"); ok {
+		backing, ok := f.mappings[mapperName]
+		if !ok {
+			return nil, 0, fmt.Errorf("mapping %s is not active", mapperName)
+		}
+		dev := f.Devices[backing]
+		return dev, dev.MappedSize, nil
+	}
+
+	dev, err := f.device(device)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dev, dev.Size, nil
+}
+
+func (f *FakeBlockOps) IsLuks(device string) bool {
+	f.call("IsLuks", device)
+	dev, err := f.device(device)
+	return err == nil && dev.Luks
+}
+
+func (f *FakeBlockOps) LuksFormat(device, passphrase string, args []string) error {
+	if err := f.call("LuksFormat", device); err != nil {
+		return err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return err
+	}
+
+	params := LuksParams{Cipher: "aes-xts-plain64", KeySize: 512, SectorSize: 512}
+	label := ""
+	for i := 0; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "--cipher":
+			params.Cipher = args[i+1]
+		case "--key-size":
+			params.KeySize, _ = strconv.Atoi(args[i+1])
+		case "--sector-size":
+			params.SectorSize, _ = strconv.Atoi(args[i+1])
+		case "--integrity":
+			params.Integrity = args[i+1]
+		case "--label":
+			label = args[i+1]
+		}
+	}
+
+	dev.Luks = true
+	dev.Plain = false
+	dev.Foreign = nil
+	dev.Keyslots = []string{passphrase}
+	dev.Params = params
+	dev.Label = label
+	dev.Tokens = make(map[string]*Token)
+	dev.FS = nil
+	return nil
+}
+
+func (f *FakeBlockOps) LuksOpen(device, mapperName, passphrase string) error {
+	if err := f.call("LuksOpen", device, mapperName); err != nil {
+		return err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return err
+	}
+	if !dev.Luks {
+		return fmt.Errorf("%s is not a LUKS device", device)
+	}
+	if dev.keyslot(passphrase) < 0 {
+		return fmt.Errorf("failed to open LUKS device: no key available with this passphrase")
+	}
+	if _, ok := f.mappings[mapperName]; ok {
+		return fmt.Errorf("mapping %s already exists", mapperName)
+	}
+
+	f.mappings[mapperName] = device
+	dev.MappedSize = dev.Size - fakeLuksOffset
+	return nil
+}
+
+// PlainOpen maps the device under a new key: whatever the previous key
+// encrypted is lost.
+func (f *FakeBlockOps) PlainOpen(device, mapperName string, key []byte, args []string) error {
+	if err := f.call("PlainOpen", device, mapperName); err != nil {
+		return err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.mappings[mapperName]; ok {
+		return fmt.Errorf("mapping %s already exists", mapperName)
+	}
+
+	f.mappings[mapperName] = device
+	dev.Luks = false
+	dev.Tokens = make(map[string]*Token)
+	dev.Foreign = nil
+	dev.Plain = true
+	dev.FS = nil
+	dev.MappedSize = dev.Size
+	return nil
+}
+
+func (f *FakeBlockOps) LuksClose(mapperName string) error {
+	if err := f.call("LuksClose", mapperName); err != nil {
+		return err
+	}
+	if _, ok := f.mappings[mapperName]; !ok {
+		return fmt.Errorf("mapping %s is not active", mapperName)
+	}
+	delete(f.mappings, mapperName)
+	return nil
+}
+
+func (f *FakeBlockOps) LuksStatus(mapperName string) (LuksStatus, error) {
+	if err := f.call("LuksStatus", mapperName); err != nil {
+		return LuksStatus{}, err
+	}
+	backing, ok := f.mappings[mapperName]
+	if !ok {
+		return LuksStatus{}, fmt.Errorf("mapping %s is not active", mapperName)
+	}
+	return LuksStatus{
+		Device: backing,
+		Offset: fakeLuksOffset,
+		Size:   f.Devices[backing].MappedSize,
+	}, nil
+}
+
+func (f *FakeBlockOps) LuksResize(mapperName, passphrase string) error {
+	if err := f.call("LuksResize", mapperName); err != nil {
+		return err
+	}
+	backing, ok := f.mappings[mapperName]
+	if !ok {
+		return fmt.Errorf("mapping %s is not active", mapperName)
+	}
+	dev := f.Devices[backing]
+	if dev.keyslot(passphrase) < 0 {
+		return fmt.Errorf("failed to resize LUKS mapping: no key available with this passphrase")
+	}
+	dev.MappedSize = dev.Size - fakeLuksOffset
+	return nil
+}
+
+func (f *FakeBlockOps) LuksParams(device string) (LuksParams, error) {
+	if err := f.call("LuksParams", device); err != nil {
+		return LuksParams{}, err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return LuksParams{}, err
+	}
+	if !dev.Luks {
+		return LuksParams{}, fmt.Errorf("%s is not a LUKS device", device)
+	}
+	return dev.Params, nil
+}
+
+func (f *FakeBlockOps) LuksLabel(device string) (string, error) {
+	if err := f.call("LuksLabel", device); err != nil {
+		return "", err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return "", err
+	}
+	if !dev.Luks {
+		return "", fmt.Errorf("%s is not a LUKS device", device)
+	}
+	return dev.Label, nil
+}
+
+func (f *FakeBlockOps) LuksAddKey(device, passphrase, newPassphrase string) error {
+	if err := f.call("LuksAddKey", device); err != nil {
+		return err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return err
+	}
+	if !dev.Luks || dev.keyslot(passphrase) < 0 {
+		return fmt.Errorf("failed to add LUKS key: no key available with this passphrase")
+	}
+	for i, key := range dev.Keyslots {
+		if key == "" {
+			dev.Keyslots[i] = newPassphrase
+			return nil
+		}
+	}
+	dev.Keyslots = append(dev.Keyslots, newPassphrase)
+	return nil
+}
+
+func (f *FakeBlockOps) LuksRemoveKey(device, passphrase string) error {
+	if err := f.call("LuksRemoveKey", device); err != nil {
+		return err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return err
+	}
+	slot := dev.keyslot(passphrase)
+	if !dev.Luks || slot < 0 {
+		return fmt.Errorf("failed to remove LUKS key: no key available with this passphrase")
+	}
+	dev.Keyslots[slot] = ""
+	return nil
+}
+
+func (f *FakeBlockOps) LuksKeyslots(device string) ([]int, error) {
+	if err := f.call("LuksKeyslots", device); err != nil {
+		return nil, err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return nil, err
+	}
+	if !dev.Luks {
+		return nil, fmt.Errorf("%s is not a LUKS device", device)
+	}
+
+	var slots []int
+	for i, key := range dev.Keyslots {
+		if key != "" {
+			slots = append(slots, i)
+		}
+	}
+	return slots, nil
+}
+
+func (f *FakeBlockOps) LuksKeyslot(device, passphrase string) (int, error) {
+	if err := f.call("LuksKeyslot", device); err != nil {
+		return -1, err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return -1, err
+	}
+	slot := dev.keyslot(passphrase)
+	if !dev.Luks || slot < 0 {
+		return -1, fmt.Errorf("no keyslot of %s accepts the passphrase", device)
+	}
+	return slot, nil
+}
+
+func (f *FakeBlockOps) LuksKillSlot(device string, slot int, passphrase string) error {
+	if err := f.call("LuksKillSlot", device, strconv.Itoa(slot)); err != nil {
+		return err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return err
+	}
+	if !dev.Luks || dev.keyslot(passphrase) < 0 {
+		return fmt.Errorf("failed to remove LUKS keyslot %d: no key available with this passphrase", slot)
+	}
+	if slot < 0 || slot >= len(dev.Keyslots) || dev.Keyslots[slot] == "" {
+		return fmt.Errorf("failed to remove LUKS keyslot %d: keyslot is not in use", slot)
+	}
+	dev.Keyslots[slot] = ""
+	return nil
+}
+
+// encrypted reports whether FS is only visible through a mapping.
+func (d *FakeDevice) encrypted() bool {
+	return d.Luks || d.Plain
+}
+
+// keyslot returns the slot passphrase opens. Removed slots are kept as ""
+// so the others keep their numbers, as in a LUKS header.
+func (d *FakeDevice) keyslot(passphrase string) int {
+	if passphrase == "" {
+		return -1
+	}
+	for i, key := range d.Keyslots {
+		if key == passphrase {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *FakeBlockOps) ExportToken(device, tokenID string) (*Token, error) {
+	if err := f.call("ExportToken", device, tokenID); err != nil {
+		return nil, err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return nil, err
+	}
+	token, ok := dev.Tokens[tokenID]
+	if !dev.Luks || !ok {
+		return nil, fmt.Errorf("no token %s on %s", tokenID, device)
+	}
+
+	copied := *token
+	copied.UserData = make(map[string]string, len(token.UserData))
+	for k, v := range token.UserData {
+		copied.UserData[k] = v
+	}
+	return &copied, nil
+}
+
+func (f *FakeBlockOps) ImportToken(device, tokenID string, token *Token) error {
+	if err := f.call("ImportToken", device, tokenID); err != nil {
+		return err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return err
+	}
+	if !dev.Luks {
+		return fmt.Errorf("%s is not a LUKS device", device)
+	}
+
+	copied := *token
+	copied.UserData = make(map[string]string, len(token.UserData))
+	for k, v := range token.UserData {
+		copied.UserData[k] = v
+	}
+	dev.Tokens[tokenID] = &copied
+	return nil
+}
+
+// Mkfs on a plain device overwrites any LUKS header, as the real mkfs does.
+func (f *FakeBlockOps) Mkfs(device, fsType string, options []string) error {
+	if err := f.call("Mkfs", device, fsType); err != nil {
+		return err
+	}
+	dev, size, err := f.open(device)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(device, "/dev/mapper/") {
+		dev.Luks = false
+		dev.Plain = false
+		dev.Tokens = make(map[string]*Token)
+		dev.Foreign = nil
+	}
+	dev.FS = &FakeFS{Type: fsType, Size: size}
+	return nil
+}
+
+func (f *FakeBlockOps) FilesystemType(device string) string {
+	f.call("FilesystemType", device)
+	dev, _, err := f.open(device)
+	if err != nil || dev.FS == nil || (dev.encrypted() && !strings.HasPrefix(device, "/dev/mapper/")) {
+		return ""
+	}
+	return dev.FS.Type
+}
+
+func (f *FakeBlockOps) FilesystemSize(device, mountPoint, fsType string) (int64, int64, error) {
+	if err := f.call("FilesystemSize", device); err != nil {
+		return 0, 0, err
+	}
+	dev, _, err := f.open(device)
+	if err != nil {
+		return 0, 0, err
+	}
+	if dev.FS == nil {
+		return 0, 0, fmt.Errorf("no filesystem on %s", device)
+	}
+	return dev.FS.Size, 4096, nil
+}
+
+func (f *FakeBlockOps) GrowFilesystem(device, mountPoint, fsType string) error {
+	if err := f.call("GrowFilesystem", device); err != nil {
+		return err
+	}
+	dev, size, err := f.open(device)
+	if err != nil {
+		return err
+	}
+	if dev.FS == nil {
+		return fmt.Errorf("no filesystem on %s", device)
+	}
+	dev.FS.Size = size
+	return nil
+}
+
+func (f *FakeBlockOps) Mount(device, mountPoint, fsType string, options []string) error {
+	if err := f.call("Mount", device, mountPoint); err != nil {
+		return err
+	}
+	dev, _, err := f.open(device)
+	if err != nil {
+		return err
+	}
+	if dev.FS == nil || (dev.encrypted() && !strings.HasPrefix(device, "/dev/mapper/")) {
+		return fmt.Errorf("failed to mount device: no filesystem on %s", device)
+	}
+	if fsType != "" && dev.FS.Type != fsType {
+		return fmt.Errorf("failed to mount device: %s is %s, not %s", device, dev.FS.Type, fsType)
+	}
+	f.Mounts[mountPoint] = device
+	return nil
+}
+
+func (f *FakeBlockOps) Unmount(mountPoint string) error {
+	if err := f.call("Unmount", mountPoint); err != nil {
+		return err
+	}
+	if _, ok := f.Mounts[mountPoint]; !ok {
+		return fmt.Errorf("%s is not mounted", mountPoint)
+	}
+	delete(f.Mounts, mountPoint)
+	return nil
+}
+
+func (f *FakeBlockOps) IsMounted(mountPoint string) bool {
+	f.call("IsMounted", mountPoint)
+	_, ok := f.Mounts[mountPoint]
+	return ok
+}
+
+func (f *FakeBlockOps) DeviceSize(device string) (int64, error) {
+	if err := f.call("DeviceSize", device); err != nil {
+		return 0, err
+	}
+	_, size, err := f.open(device)
+	return size, err
+}
+
+func (f *FakeBlockOps) Signatures(device string) ([]string, error) {
+	if err := f.call("Signatures", device); err != nil {
+		return nil, err
+	}
+	dev, err := f.device(device)
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := append([]string{}, dev.Foreign...)
+	if dev.Luks {
+		signatures = append(signatures, "LUKS2 at 0x0")
+	} else if dev.FS != nil && !dev.Plain {
+		signatures = append(signatures, dev.FS.Type+" at 0x0")
+	}
+	return signatures, nil
+}
@@ -1,12 +1,10 @@
 package disks
 
 import (
-	"bufio"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
@@ -16,7 +14,7 @@ type DiskFinder interface {
 	Find() (string, error)
 }
 
-func CreateDiskFinder(cfg config.DiskConfig) (DiskFinder, error) {
+func CreateDiskFinder(name string, cfg config.DiskConfig) (DiskFinder, error) {
 	switch cfg.Strategy {
 	case "largest":
 		return NewLargestDiskFinder(), nil
@@ -28,6 +26,22 @@ func CreateDiskFinder(cfg config.DiskConfig) (DiskFinder, error) {
 		}
 		return NewPathGlobFinder(pattern), nil
 
+	case "identity":
+		return NewIdentityFinder(cfg.StrategyConfig), nil
+
+	case "raid":
+		raid := NewRaidFinder(name, cfg.StrategyConfig)
+		raid.AllowWipeForeign = mayWipeForeign(cfg)
+		return raid, nil
+
+	case "partition":
+		partition, err := NewPartitionFinder(name, cfg.StrategyConfig)
+		if err != nil {
+			return nil, err
+		}
+		partition.AllowWipeForeign = mayWipeForeign(cfg)
+		return partition, nil
+
 	default:
 		return nil, fmt.Errorf("unknown disk strategy: %s", cfg.Strategy)
 	}
@@ -86,57 +100,5 @@ func isBootDevice(device string) bool {
 }
 
 func FindLargestDisk() (string, error) {
-	file, err := os.Open("/proc/partitions")
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	var largestDevice string
-	var largestSize int64
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		if strings.HasPrefix(line, "major") || line == "" {
-			continue
-		}
-
-		fields := strings.Fields(line)
-		if len(fields) < 4 {
-			continue
-		}
-
-		deviceName := fields[3]
-
-		hasSCSI := strings.HasPrefix(deviceName, "sd")
-		hasSdNumber := strings.ContainsAny(deviceName[len(deviceName)-1:], "0123456789")
-
-		if !hasSCSI || hasSdNumber {
-			continue
-		}
-
-		sizeBlocks, err := strconv.ParseInt(fields[2], 10, 64)
-		if err != nil {
-			continue
-		}
-
-		sizeBytes := sizeBlocks * 1024
-
-		if sizeBytes > largestSize {
-			largestSize = sizeBytes
-			largestDevice = "/dev/" + deviceName
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return "", err
-	}
-
-	if largestDevice == "" {
-		return "", fmt.Errorf("no SCSI disk found")
-	}
-
-	return largestDevice, nil
+	return NewLargestDiskFinder().Find()
 }
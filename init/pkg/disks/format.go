@@ -0,0 +1,145 @@
+package disks
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// luksLabel is set in the header by luksFormat, so a crash before the first
+// phase is recorded still leaves the disk recognizable as tdx-init's.
+const luksLabel = "tdx-init"
+
+// formatStep is one step of formatting an encrypted disk. Phase is recorded
+// in the init token once the step is done; undo, if set, reverts the step
+// when a later one fails.
+type formatStep struct {
+	phase string
+	run   func() error
+	undo  func()
+}
+
+// formatDisk formats an encrypted disk as a sequence of steps. Until the
+// last step writes the complete init token, the token only records the
+// phase reached, so a disk left behind by a crash is not taken as
+// initialized and is formatted again on the next boot. On error the steps
+// done so far are undone, leaving no mapping open or mounted.
+func (dm *Manager) formatDisk(ctx context.Context, disk *ManagedDisk) error {
+	if disk.Config.EncryptionKey == "" {
+		return dm.formatPlainDisk(disk)
+	}
+
+	if err := dm.checkWipe(disk); err != nil {
+		return err
+	}
+
+	// Get encryption passphrase, generating a fresh one if the provider supports it
+	passphrase, err := dm.keyManager.NewKey(ctx, disk.Config.EncryptionKey)
+	if err != nil {
+		return fmt.Errorf("failed to get encryption key: %w", err)
+	}
+
+	var steps []formatStep
+
+	// With integrity set, dm-integrity first wipes the whole device so
+	// every sector has a valid tag.
+	steps = append(steps, formatStep{
+		phase: "luks_formatted",
+		run: func() error {
+			log.Printf("Formatting %s with LUKS2 encryption", disk.DevicePath)
+			args := append(luksFormatArgs(disk.Config.LUKS), "--label", luksLabel)
+			return dm.ops.LuksFormat(disk.DevicePath, passphrase, args)
+		},
+	})
+
+	if disk.Config.Recovery != nil {
+		steps = append(steps, formatStep{
+			phase: "recovery_added",
+			run: func() error {
+				if _, err := dm.addRecoveryKey(disk, passphrase); err != nil {
+					return fmt.Errorf("failed to add recovery key: %w", err)
+				}
+				return nil
+			},
+		})
+	}
+
+	steps = append(steps,
+		formatStep{
+			phase: "opened",
+			run: func() error {
+				return dm.ops.LuksOpen(disk.DevicePath, disk.MapperName, passphrase)
+			},
+			undo: func() {
+				if err := dm.ops.LuksClose(disk.MapperName); err != nil {
+					log.Printf("Warning: Failed to close %s: %v", disk.MapperName, err)
+				}
+			},
+		},
+		formatStep{
+			phase: "filesystem_created",
+			run: func() error {
+				return dm.createFilesystem(disk, disk.MapperDevice)
+			},
+		},
+	)
+
+	// Something else mounted at mount_at is left alone, also on error
+	if dm.ops.IsMounted(disk.Config.MountAt) {
+		log.Printf("Device already mounted at %s", disk.Config.MountAt)
+	} else {
+		steps = append(steps, formatStep{
+			phase: "mounted",
+			run: func() error {
+				if err := dm.ops.Mount(disk.MapperDevice, disk.Config.MountAt, disk.Config.FSType, disk.Config.MountOptions); err != nil {
+					return fmt.Errorf("failed to mount: %w", err)
+				}
+				return nil
+			},
+			undo: func() {
+				if err := dm.ops.Unmount(disk.Config.MountAt); err != nil {
+					log.Printf("Warning: Failed to unmount %s: %v", disk.Config.MountAt, err)
+				}
+			},
+		})
+	}
+
+	// rollback undoes the first done steps in reverse order
+	rollback := func(done int) {
+		for i := done - 1; i >= 0; i-- {
+			if steps[i].undo != nil {
+				steps[i].undo()
+			}
+		}
+	}
+
+	for i, step := range steps {
+		if err := step.run(); err != nil {
+			rollback(i)
+			return err
+		}
+		if err := dm.storeFormatPhase(disk, step.phase); err != nil {
+			rollback(i + 1)
+			return err
+		}
+	}
+
+	// Create subdirectories
+	if err := CreateMountDirs(disk.Config.MountAt, []string{"ssh", "data", "logs"}); err != nil {
+		log.Printf("Warning: Failed to create subdirectories: %v", err)
+	}
+
+	// Store initialization token with what the header actually uses
+	params, err := dm.ops.LuksParams(disk.DevicePath)
+	if err != nil {
+		log.Printf("Warning: Failed to read LUKS settings: %v", err)
+	}
+	if err := dm.storeInitToken(disk, passphrase, ReadDiskIdentity(disk.DevicePath), params); err != nil {
+		rollback(len(steps))
+		return err
+	}
+
+	disk.Initialized = true
+	log.Printf("Successfully formatted and mounted encrypted disk %s", disk.Name)
+	return nil
+}
@@ -0,0 +1,132 @@
+package disks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var formatCrashTests = []testDiskOptions{
+	{format: "on_initialize"},
+	{format: "on_initialize", recovery: true},
+	{format: "on_fail"},
+	{format: "on_fail", recovery: true},
+}
+
+// cleanFormatCalls returns the calls a first boot makes when nothing fails.
+func cleanFormatCalls(t *testing.T, opts testDiskOptions) []string {
+	t.Helper()
+	ops := NewFakeBlockOps()
+	ops.AddDisk(testDisk, testDevice, testSize)
+	dm := newTestManager(t, ops, &testKey{key: "disk key"}, opts)
+	if err := dm.SetupDisk(context.Background(), testDisk); err != nil {
+		t.Fatalf("SetupDisk: %v", err)
+	}
+	return ops.Calls
+}
+
+// initialized reports whether the device carries a complete init token.
+func initialized(ops *FakeBlockOps) bool {
+	token, ok := ops.Devices[testDevice].Tokens[InitTokenID]
+	return ops.Devices[testDevice].Luks && ok && token.UserData["initialized"] == "true"
+}
+
+func TestFormatSurvivesCrashAtEveryCall(t *testing.T) {
+	for _, opts := range formatCrashTests {
+		calls := cleanFormatCalls(t, opts)
+		// The first call cannot be crashed at, as CrashAfter 0 disables it
+		for crash := 1; crash < len(calls); crash++ {
+			name := fmt.Sprintf("%s/recovery=%v/crash at %d (%s)", opts.format, opts.recovery, crash+1, calls[crash])
+			t.Run(name, func(t *testing.T) {
+				ops := NewFakeBlockOps()
+				ops.AddDisk(testDisk, testDevice, testSize)
+				key := &testKey{key: "disk key"}
+
+				ops.CrashAfter = crash
+				dm := newTestManager(t, ops, key, opts)
+				err := dm.SetupDisk(context.Background(), testDisk)
+				disk, _ := dm.GetDisk(testDisk)
+				if err == nil {
+					t.Fatal("SetupDisk succeeded despite the crash")
+				}
+				if initialized(ops) {
+					if fs := ops.Devices[testDevice].FS; fs == nil {
+						t.Fatal("init token written before the filesystem")
+					}
+					if ops.Mounts[disk.Config.MountAt] != disk.MapperDevice {
+						t.Fatal("init token written before the filesystem was mounted")
+					}
+				}
+
+				ops.Reboot()
+				dm = newTestManager(t, ops, key, opts)
+				if err := dm.SetupDisk(context.Background(), testDisk); err != nil {
+					t.Fatalf("SetupDisk after reboot: %v", err)
+				}
+				disk, _ = dm.GetDisk(testDisk)
+				if !initialized(ops) {
+					t.Fatal("disk not initialized after reboot")
+				}
+				if ops.Mounts[disk.Config.MountAt] != disk.MapperDevice {
+					t.Fatalf("mounted %q at %s, want %s", ops.Mounts[disk.Config.MountAt], disk.Config.MountAt, disk.MapperDevice)
+				}
+				if opts.recovery && !dm.hasRecoveryKey(testDevice) {
+					t.Fatal("formatted without the recovery keyslot")
+				}
+			})
+		}
+	}
+}
+
+func TestFormatFailureLeavesNothingOpen(t *testing.T) {
+	for _, opts := range formatCrashTests {
+		calls := cleanFormatCalls(t, opts)
+		failed := make(map[string]bool)
+		for _, call := range calls {
+			method, _, _ := strings.Cut(call, " ")
+			if failed[method] {
+				continue
+			}
+			failed[method] = true
+
+			t.Run(fmt.Sprintf("%s/recovery=%v/%s fails", opts.format, opts.recovery, method), func(t *testing.T) {
+				ops := NewFakeBlockOps()
+				ops.AddDisk(testDisk, testDevice, testSize)
+				key := &testKey{key: "disk key"}
+
+				ops.FailOn[method] = errors.New("injected failure")
+				dm := newTestManager(t, ops, key, opts)
+				err := dm.SetupDisk(context.Background(), testDisk)
+				disk, _ := dm.GetDisk(testDisk)
+				if err == nil {
+					// Some calls are best effort; the disk must then be usable
+					if ops.Mounts[disk.Config.MountAt] != disk.MapperDevice {
+						t.Fatalf("SetupDisk succeeded without mounting %s", disk.MapperDevice)
+					}
+					return
+				}
+				if initialized(ops) {
+					t.Fatal("init token written although SetupDisk failed")
+				}
+				if device := ops.Mounts[disk.Config.MountAt]; device != "" {
+					t.Fatalf("left %s mounted after error", device)
+				}
+				if _, ok := ops.mappings[disk.MapperName]; ok {
+					t.Fatalf("left mapping %s open after error", disk.MapperName)
+				}
+
+				delete(ops.FailOn, method)
+				ops.Reboot()
+				dm = newTestManager(t, ops, key, opts)
+				if err := dm.SetupDisk(context.Background(), testDisk); err != nil {
+					t.Fatalf("SetupDisk after reboot: %v", err)
+				}
+				if !initialized(ops) {
+					t.Fatal("disk not initialized after reboot")
+				}
+			})
+		}
+	}
+}
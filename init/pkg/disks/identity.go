@@ -0,0 +1,206 @@
+package disks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiskIdentity holds the stable identifiers of a whole disk. WWN and Serial
+// belong to the disk itself; ByPath describes where it is attached and is
+// recorded for diagnostics only.
+type DiskIdentity struct {
+	WWN    string
+	Serial string
+	ByPath string
+}
+
+// IdentityFinder selects a disk by stable identifiers. Every configured
+// identifier must match, and exactly one disk may match.
+type IdentityFinder struct {
+	WWN      string
+	Serial   string
+	ByID     string
+	ByPath   string
+	AzureLUN string
+	GCPName  string
+}
+
+func NewIdentityFinder(cfg map[string]interface{}) *IdentityFinder {
+	f := &IdentityFinder{}
+	f.WWN, _ = cfg["wwn"].(string)
+	f.Serial, _ = cfg["serial"].(string)
+	f.ByID, _ = cfg["by_id"].(string)
+	f.ByPath, _ = cfg["by_path"].(string)
+	f.GCPName, _ = cfg["gcp_name"].(string)
+	if lun, ok := cfg["azure_lun"]; ok {
+		f.AzureLUN = fmt.Sprint(lun)
+	}
+	return f
+}
+
+func (f *IdentityFinder) Find() (string, error) {
+	var links []string
+	if f.ByID != "" {
+		links = append(links, filepath.Join("/dev/disk/by-id", f.ByID))
+	}
+	if f.ByPath != "" {
+		links = append(links, filepath.Join("/dev/disk/by-path", f.ByPath))
+	}
+	if f.GCPName != "" {
+		links = append(links, filepath.Join("/dev/disk/by-id", "google-"+f.GCPName))
+	}
+
+	var candidates []string
+	for _, link := range links {
+		device, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			return "", fmt.Errorf("no disk found at %s", link)
+		}
+		candidates = append(candidates, device)
+	}
+
+	if f.AzureLUN != "" {
+		device, err := resolveAzureLUN(f.AzureLUN)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, device)
+	}
+
+	for i := 1; i < len(candidates); i++ {
+		if candidates[i] != candidates[0] {
+			return "", fmt.Errorf("disk identifiers resolve to different devices %s and %s", candidates[0], candidates[i])
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = wholeDisks()
+	}
+
+	var matches []string
+	for _, device := range candidates {
+		identity := ReadDiskIdentity(device)
+		if f.WWN != "" && !strings.EqualFold(identity.WWN, f.WWN) {
+			continue
+		}
+		if f.Serial != "" && identity.Serial != f.Serial {
+			continue
+		}
+		matches = append(matches, device)
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no disk matches the configured identity")
+	case 1:
+		if isBootDevice(matches[0]) {
+			return "", fmt.Errorf("disk %s matching the configured identity is the boot device", matches[0])
+		}
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("configured identity matches %d disks: %s", len(matches), strings.Join(matches, ", "))
+	}
+}
+
+// resolveAzureLUN follows the symlinks created by the Azure udev rules,
+// either from waagent or from azure-vm-utils.
+func resolveAzureLUN(lun string) (string, error) {
+	for _, link := range []string{
+		filepath.Join("/dev/disk/azure/data/by-lun", lun),
+		filepath.Join("/dev/disk/azure/scsi1", "lun"+lun),
+	} {
+		if device, err := filepath.EvalSymlinks(link); err == nil {
+			return device, nil
+		}
+	}
+	return "", fmt.Errorf("no Azure data disk at LUN %s", lun)
+}
+
+// wholeDisks lists block devices backed by hardware, skipping partitions and
+// virtual devices such as loop and device-mapper.
+func wholeDisks() []string {
+	entries, err := os.ReadDir("/sys/class/block")
+	if err != nil {
+		return nil
+	}
+
+	var devices []string
+	for _, entry := range entries {
+		sys := filepath.Join("/sys/class/block", entry.Name())
+		if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sys, "device")); err != nil {
+			continue
+		}
+		devices = append(devices, "/dev/"+entry.Name())
+	}
+	return devices
+}
+
+// ReadDiskIdentity reads a disk's identifiers from sysfs. Missing
+// identifiers are left empty.
+func ReadDiskIdentity(devicePath string) DiskIdentity {
+	if resolved, err := filepath.EvalSymlinks(devicePath); err == nil {
+		devicePath = resolved
+	}
+	sys := filepath.Join("/sys/class/block", filepath.Base(devicePath))
+
+	// A partition carries the identity of the disk it is on
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		if resolved, err := filepath.EvalSymlinks(sys); err == nil {
+			sys = filepath.Dir(resolved)
+		}
+	}
+
+	identity := DiskIdentity{
+		WWN:    readSysfsAttr(filepath.Join(sys, "wwid"), filepath.Join(sys, "device", "wwid")),
+		Serial: readSysfsAttr(filepath.Join(sys, "serial"), filepath.Join(sys, "device", "serial")),
+	}
+
+	// SCSI disks only expose their serial through the unit serial number
+	// VPD page, which starts with a 4-byte header.
+	if identity.Serial == "" {
+		if page, err := os.ReadFile(filepath.Join(sys, "device", "vpd_pg80")); err == nil && len(page) > 4 {
+			identity.Serial = strings.TrimSpace(string(page[4:]))
+		}
+	}
+
+	if links, err := filepath.Glob("/dev/disk/by-path/*"); err == nil {
+		for _, link := range links {
+			if target, err := filepath.EvalSymlinks(link); err == nil && target == devicePath {
+				identity.ByPath = filepath.Base(link)
+				break
+			}
+		}
+	}
+
+	return identity
+}
+
+// Mismatch reports why a disk does not carry the recorded identity, or ""
+// if it does. Identifiers missing on either side are not compared.
+func (recorded DiskIdentity) Mismatch(actual DiskIdentity) string {
+	if recorded.WWN != "" && actual.WWN != "" && !strings.EqualFold(recorded.WWN, actual.WWN) {
+		return fmt.Sprintf("WWN %s, recorded %s", actual.WWN, recorded.WWN)
+	}
+	if recorded.Serial != "" && actual.Serial != "" && recorded.Serial != actual.Serial {
+		return fmt.Sprintf("serial %s, recorded %s", actual.Serial, recorded.Serial)
+	}
+	return ""
+}
+
+func readSysfsAttr(paths ...string) string {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if value := strings.TrimSpace(string(data)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
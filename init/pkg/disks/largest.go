@@ -1,13 +1,16 @@
 package disks
 
 import (
-	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// sysBlock lists whole disks of every type: sd, nvme, vd, xvd, ...
+const sysBlock = "/sys/block"
+
 type LargestDiskFinder struct{}
 
 func NewLargestDiskFinder() *LargestDiskFinder {
@@ -15,57 +18,66 @@ func NewLargestDiskFinder() *LargestDiskFinder {
 }
 
 func (f *LargestDiskFinder) Find() (string, error) {
-	file, err := os.Open("/proc/partitions")
+	entries, err := os.ReadDir(sysBlock)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
 
 	var largestDevice string
 	var largestSize int64
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		if strings.HasPrefix(line, "major") || line == "" {
+	for _, entry := range entries {
+		name := entry.Name()
+		if !isCandidateDisk(name) {
 			continue
 		}
 
-		fields := strings.Fields(line)
-		if len(fields) < 4 {
+		device := "/dev/" + name
+		if isBootDevice(device) {
 			continue
 		}
 
-		deviceName := fields[3]
-
-		hasSCSI := strings.HasPrefix(deviceName, "sd")
-		hasSdNumber := strings.ContainsAny(deviceName[len(deviceName)-1:], "0123456789")
-
-		if !hasSCSI || hasSdNumber {
-			continue
-		}
-
-		sizeBlocks, err := strconv.ParseInt(fields[2], 10, 64)
+		sectors, err := strconv.ParseInt(readSysBlockAttr(name, "size"), 10, 64)
 		if err != nil {
 			continue
 		}
 
-		sizeBytes := sizeBlocks * 1024
+		// sysfs sizes are in 512-byte sectors regardless of the block size
+		sizeBytes := sectors * 512
 
 		if sizeBytes > largestSize {
 			largestSize = sizeBytes
-			largestDevice = "/dev/" + deviceName
+			largestDevice = device
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return "", err
-	}
-
 	if largestDevice == "" {
-		return "", fmt.Errorf("no SCSI disk found")
+		return "", fmt.Errorf("no disk found")
 	}
 
 	return largestDevice, nil
-}
\ No newline at end of file
+}
+
+// isCandidateDisk rejects virtual, removable and read-only devices. Virtual
+// devices such as dm and md have no backing device link.
+func isCandidateDisk(name string) bool {
+	for _, prefix := range []string{"loop", "ram", "zram"} {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(sysBlock, name, "device")); err != nil {
+		return false
+	}
+
+	return readSysBlockAttr(name, "removable") != "1" && readSysBlockAttr(name, "ro") != "1"
+}
+
+func readSysBlockAttr(name, attr string) string {
+	data, err := os.ReadFile(filepath.Join(sysBlock, name, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
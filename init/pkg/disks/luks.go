@@ -1,16 +1,22 @@
 package disks
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/attestation"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/keys"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/version"
 )
 
 const (
-	InitTokenID = "1"
-	SSHTokenID  = "2"
+	InitTokenID     = "1"
+	SSHTokenID      = "2"
+	RecoveryTokenID = "3"
 )
 
 type Token struct {
@@ -19,114 +25,297 @@ type Token struct {
 	UserData map[string]string `json:"user_data"`
 }
 
-func IsLuksDevice(devicePath string) bool {
-	cmd := exec.Command("cryptsetup", "isLuks", devicePath)
-	return cmd.Run() == nil
-}
+// initTokenSchema is the layout version of the init token written by
+// storeInitToken. Tokens without a schema field are version 1, which
+// records no key, filesystem or image details.
+const initTokenSchema = 2
+
+var errNoInitToken = errors.New("no init token found")
 
-func IsInitialized(devicePath string) bool {
-	cmd := exec.Command("cryptsetup", "token", "export", "--token-id", InitTokenID, devicePath)
-	output, err := cmd.Output()
+// initToken returns the user data of the init token after checking that
+// this release understands it. A header without a completed token yields
+// errNoInitToken.
+func (dm *Manager) initToken(devicePath string) (map[string]string, error) {
+	token, err := dm.ops.ExportToken(devicePath, InitTokenID)
+	if err != nil || token.UserData["initialized"] != "true" {
+		return nil, errNoInitToken
+	}
+	if token.Type != "tdx-init" {
+		return nil, fmt.Errorf("token %s of %s has type %s, not tdx-init", InitTokenID, devicePath, token.Type)
+	}
+
+	schema, err := tokenSchema(token.UserData)
 	if err != nil {
-		return false
+		return nil, fmt.Errorf("init token of %s: %w", devicePath, err)
+	}
+	if schema > initTokenSchema {
+		return nil, fmt.Errorf("init token of %s has schema %d, this tdx-init only reads up to %d", devicePath, schema, initTokenSchema)
 	}
 
-	var token Token
-	if err := json.Unmarshal(output, &token); err != nil {
-		return false
+	required := []string{"disk_name"}
+	if schema >= 2 {
+		required = append(required, "key_strategy", "fs_type")
+		// A migrated token has no creation time; it was never recorded
+		if _, ok := token.UserData["migrated_from"]; !ok {
+			required = append(required, "created_at")
+		}
+	}
+	for _, field := range required {
+		if token.UserData[field] == "" {
+			return nil, fmt.Errorf("init token of %s has no %s", devicePath, field)
+		}
+	}
+	for _, field := range []string{"created_at", "migrated_at"} {
+		if value, ok := token.UserData[field]; ok {
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				return nil, fmt.Errorf("init token of %s has invalid %s %q", devicePath, field, value)
+			}
+		}
 	}
 
-	return token.UserData["initialized"] == "true"
+	return token.UserData, nil
 }
 
-func FormatLuks(devicePath, passphrase string) error {
-	log.Printf("Formatting %s with LUKS2 encryption", devicePath)
+func tokenSchema(data map[string]string) (int, error) {
+	value, ok := data["schema"]
+	if !ok {
+		return 1, nil
+	}
+	schema, err := strconv.Atoi(value)
+	if err != nil || schema < 1 {
+		return 0, fmt.Errorf("invalid schema %q", value)
+	}
+	return schema, nil
+}
 
-	cmd := exec.Command("cryptsetup", "luksFormat", "--type", "luks2", "-q", devicePath)
-	cmd.Stdin = strings.NewReader(passphrase)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to format with LUKS: %w", err)
+// isInitialized reports whether the header carries a completed init
+// token. A token this release cannot read is an error, so the disk is
+// refused rather than formatted again.
+func (dm *Manager) isInitialized(devicePath string) (bool, error) {
+	_, err := dm.initToken(devicePath)
+	if errors.Is(err, errNoInitToken) {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	return nil
+// InitToken returns the init token of a disk, e.g. to audit when and by
+// which image it was formatted.
+func (dm *Manager) InitToken(name string) (map[string]string, error) {
+	disk, err := dm.LocateDisk(name)
+	if err != nil {
+		return nil, err
+	}
+	return dm.initToken(disk.DevicePath)
 }
 
-func OpenLuks(devicePath, mapperName, passphrase string) error {
-	cmd := exec.Command("cryptsetup", "open", devicePath, mapperName)
-	cmd.Stdin = strings.NewReader(passphrase)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to open LUKS device: %w", err)
+// initIdentity returns the disk identity recorded in the init token.
+// Tokens written before identities were recorded yield an empty identity.
+func (dm *Manager) initIdentity(devicePath string) (DiskIdentity, error) {
+	data, err := dm.initToken(devicePath)
+	if err != nil {
+		return DiskIdentity{}, err
 	}
-	return nil
+
+	return DiskIdentity{
+		WWN:    data["wwn"],
+		Serial: data["serial"],
+		ByPath: data["by_path"],
+	}, nil
 }
 
-func CloseLuks(mapperName string) error {
-	return exec.Command("cryptsetup", "close", mapperName).Run()
+// initLuksParams returns the encryption settings recorded in the init
+// token. Older tokens yield empty settings.
+func (dm *Manager) initLuksParams(devicePath string) (LuksParams, error) {
+	data, err := dm.initToken(devicePath)
+	if err != nil {
+		return LuksParams{}, err
+	}
+
+	return luksParamsFromToken(data), nil
 }
 
-func StoreInitToken(devicePath, diskName string) error {
-	token := Token{
+// storeInitToken marks the disk as initialized and records how it was
+// formatted. The key is only kept as a fingerprint.
+func (dm *Manager) storeInitToken(disk *ManagedDisk, passphrase string, identity DiskIdentity, params LuksParams) error {
+	fingerprint, err := keys.Fingerprint(passphrase)
+	if err != nil {
+		return err
+	}
+
+	token := &Token{
+		Type:     "tdx-init",
+		Keyslots: []string{},
+		UserData: params.tokenData(),
+	}
+	token.UserData["schema"] = strconv.Itoa(initTokenSchema)
+	token.UserData["initialized"] = "true"
+	token.UserData["disk_name"] = disk.Name
+	token.UserData["created_at"] = time.Now().UTC().Format(time.RFC3339)
+	token.UserData["tdx_init_version"] = version.String()
+	token.UserData["key_strategy"] = dm.keyConfigs[disk.Config.EncryptionKey].Strategy
+	token.UserData["key_fingerprint"] = fingerprint
+	token.UserData["fs_type"] = disk.Config.FSType
+	if identity.WWN != "" {
+		token.UserData["wwn"] = identity.WWN
+	}
+	if identity.Serial != "" {
+		token.UserData["serial"] = identity.Serial
+	}
+	if identity.ByPath != "" {
+		token.UserData["by_path"] = identity.ByPath
+	}
+
+	// Outside a TD, e.g. in development, there is nothing to record
+	if measurement, err := attestation.ReadMeasurement(); err != nil {
+		log.Printf("Warning: Failed to read image measurement: %v", err)
+	} else {
+		token.UserData["mrtd"] = measurement.MRTD
+		token.UserData["rtmr0"] = measurement.RTMR0
+		token.UserData["rtmr1"] = measurement.RTMR1
+		token.UserData["rtmr2"] = measurement.RTMR2
+	}
+
+	if err := dm.ops.ImportToken(disk.DevicePath, InitTokenID, token); err != nil {
+		return fmt.Errorf("failed to store init token: %w", err)
+	}
+
+	return nil
+}
+
+// storeFormatPhase writes an incomplete init token recording how far
+// formatting got. It lets a disk left behind by a crash be recognized as
+// tdx-init's own and formatted again without allow_wipe_foreign.
+func (dm *Manager) storeFormatPhase(disk *ManagedDisk, phase string) error {
+	token := &Token{
 		Type:     "tdx-init",
 		Keyslots: []string{},
 		UserData: map[string]string{
-			"initialized": "true",
-			"disk_name":   diskName,
+			"schema":       strconv.Itoa(initTokenSchema),
+			"initialized":  "false",
+			"disk_name":    disk.Name,
+			"format_phase": phase,
 		},
 	}
 
-	tokenJSON, err := json.Marshal(token)
+	if err := dm.ops.ImportToken(disk.DevicePath, InitTokenID, token); err != nil {
+		return fmt.Errorf("failed to record format phase %s: %w", phase, err)
+	}
+	return nil
+}
+
+// formatPhase returns the phase reached by a format of this disk that did
+// not complete, or "" if the header holds no incomplete init token for it.
+func (dm *Manager) formatPhase(disk *ManagedDisk) string {
+	token, err := dm.ops.ExportToken(disk.DevicePath, InitTokenID)
+	if err != nil {
+		if label, err := dm.ops.LuksLabel(disk.DevicePath); err == nil && label == luksLabel {
+			return "luks_formatted"
+		}
+		return ""
+	}
+	if token.Type != "tdx-init" || token.UserData["initialized"] == "true" ||
+		token.UserData["disk_name"] != disk.Name {
+		return ""
+	}
+	return token.UserData["format_phase"]
+}
+
+// migrateInitToken brings an init token written by an older release up to
+// the current schema. What was not recorded at format time, such as the
+// creation time and the image measurement, stays unknown.
+func (dm *Manager) migrateInitToken(disk *ManagedDisk, passphrase, fsType string) error {
+	token, err := dm.ops.ExportToken(disk.DevicePath, InitTokenID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal init token: %w", err)
+		return fmt.Errorf("no init token found")
+	}
+	schema, err := tokenSchema(token.UserData)
+	if err != nil || schema >= initTokenSchema {
+		return err
+	}
+	if fsType == "" {
+		return fmt.Errorf("filesystem type of %s unknown", disk.MapperDevice)
 	}
 
-	cmd := exec.Command("cryptsetup", "token", "import", "--token-id", InitTokenID, devicePath)
-	cmd.Stdin = strings.NewReader(string(tokenJSON))
-	if err := cmd.Run(); err != nil {
+	fingerprint, err := keys.Fingerprint(passphrase)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Migrating init token of %s from schema %d to %d", disk.DevicePath, schema, initTokenSchema)
+	token.UserData["schema"] = strconv.Itoa(initTokenSchema)
+	token.UserData["migrated_from"] = strconv.Itoa(schema)
+	token.UserData["migrated_at"] = time.Now().UTC().Format(time.RFC3339)
+	token.UserData["migrated_by"] = version.String()
+	token.UserData["key_strategy"] = dm.keyConfigs[disk.Config.EncryptionKey].Strategy
+	token.UserData["key_fingerprint"] = fingerprint
+	token.UserData["fs_type"] = fsType
+
+	if err := dm.ops.ImportToken(disk.DevicePath, InitTokenID, token); err != nil {
 		return fmt.Errorf("failed to store init token: %w", err)
 	}
+	return nil
+}
 
+// recordKeyFingerprint updates the key fingerprint in the init token after
+// the disk's key was replaced.
+func (dm *Manager) recordKeyFingerprint(devicePath, key string) error {
+	token, err := dm.ops.ExportToken(devicePath, InitTokenID)
+	if err != nil {
+		return fmt.Errorf("no init token found")
+	}
+	if _, ok := token.UserData["key_fingerprint"]; !ok {
+		return nil
+	}
+
+	fingerprint, err := keys.Fingerprint(key)
+	if err != nil {
+		return err
+	}
+	token.UserData["key_fingerprint"] = fingerprint
+
+	if err := dm.ops.ImportToken(devicePath, InitTokenID, token); err != nil {
+		return fmt.Errorf("failed to store init token: %w", err)
+	}
 	return nil
 }
 
-func StoreSSHToken(devicePath, sshKey string) error {
-	token := Token{
+// StoreSSHToken stores authorized_keys lines in the ssh-key token, one per
+// line of the ssh_keys field.
+func (dm *Manager) StoreSSHToken(devicePath string, sshKeys []string) error {
+	token := &Token{
 		Type:     "ssh-key",
 		Keyslots: []string{},
 		UserData: map[string]string{
-			"ssh_key": sshKey,
+			"ssh_keys": strings.Join(sshKeys, "\n"),
 		},
 	}
 
-	tokenJSON, err := json.Marshal(token)
-	if err != nil {
-		return fmt.Errorf("failed to marshal SSH token: %w", err)
-	}
-
-	cmd := exec.Command("cryptsetup", "token", "import", "--token-id", SSHTokenID, devicePath)
-	cmd.Stdin = strings.NewReader(string(tokenJSON))
-	if err := cmd.Run(); err != nil {
+	if err := dm.ops.ImportToken(devicePath, SSHTokenID, token); err != nil {
 		return fmt.Errorf("failed to store SSH token: %w", err)
 	}
 
 	return nil
 }
 
-func GetSSHToken(devicePath string) (string, error) {
-	cmd := exec.Command("cryptsetup", "token", "export", "--token-id", SSHTokenID, devicePath)
-	output, err := cmd.Output()
+// GetSSHToken returns the stored authorized_keys lines. Tokens written by
+// older releases hold a single bare ed25519 key in ssh_key.
+func (dm *Manager) GetSSHToken(devicePath string) ([]string, error) {
+	token, err := dm.ops.ExportToken(devicePath, SSHTokenID)
 	if err != nil {
-		return "", fmt.Errorf("no SSH token found")
+		return nil, fmt.Errorf("no SSH token found")
 	}
 
-	var token Token
-	if err := json.Unmarshal(output, &token); err != nil {
-		return "", fmt.Errorf("failed to parse SSH token: %w", err)
+	if keys, ok := token.UserData["ssh_keys"]; ok {
+		if keys == "" {
+			return nil, nil
+		}
+		return strings.Split(keys, "\n"), nil
 	}
 
-	key, ok := token.UserData["ssh_key"]
-	if !ok {
-		return "", fmt.Errorf("no SSH key in token")
+	if key, ok := token.UserData["ssh_key"]; ok && key != "" {
+		return []string{"ssh-ed25519 " + key}, nil
 	}
 
-	return key, nil
+	return nil, fmt.Errorf("no SSH key in token")
 }
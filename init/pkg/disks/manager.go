@@ -2,18 +2,26 @@ package disks
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/keys"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
 )
 
 type Manager struct {
 	disks      map[string]*ManagedDisk
 	keyManager *keys.Manager
+	keyConfigs map[string]config.KeyConfig
+	ops        BlockOps
+	newFinder  FinderFunc
 }
 
+// FinderFunc creates the finder for a disk; CreateDiskFinder by default.
+type FinderFunc func(name string, cfg config.DiskConfig) (DiskFinder, error)
+
 type ManagedDisk struct {
 	Name         string
 	Config       config.DiskConfig
@@ -24,9 +32,19 @@ type ManagedDisk struct {
 }
 
 func NewManager(cfg *config.Config, km *keys.Manager) (*Manager, error) {
+	return NewManagerWithOps(cfg, km, NewExecBlockOps(), CreateDiskFinder)
+}
+
+// NewManagerWithOps creates a Manager that performs all device operations
+// through ops and finds devices through newFinder, e.g. the in-memory
+// FakeBlockOps of the tests.
+func NewManagerWithOps(cfg *config.Config, km *keys.Manager, ops BlockOps, newFinder FinderFunc) (*Manager, error) {
 	dm := &Manager{
 		disks:      make(map[string]*ManagedDisk),
 		keyManager: km,
+		keyConfigs: cfg.Keys,
+		ops:        ops,
+		newFinder:  newFinder,
 	}
 
 	for name, diskCfg := range cfg.Disks {
@@ -51,7 +69,7 @@ func (dm *Manager) SetupDisk(ctx context.Context, name string) error {
 	}
 
 	// Find the physical device
-	devicePath, err := dm.findDevice(disk.Config)
+	devicePath, err := dm.findDevice(disk)
 	if err != nil {
 		return fmt.Errorf("failed to find device for disk %s: %w", name, err)
 	}
@@ -59,11 +77,41 @@ func (dm *Manager) SetupDisk(ctx context.Context, name string) error {
 
 	log.Printf("Setting up disk %s at device %s", name, devicePath)
 
-	// Check if device has LUKS
-	isLuks := IsLuksDevice(devicePath)
+	if disk.Config.Format == "ephemeral" {
+		if err := dm.setupEphemeral(disk); err != nil {
+			return fmt.Errorf("failed to set up ephemeral disk %s: %w", name, err)
+		}
+		return nil
+	}
+
+	// Check if device has LUKS. A disk whose init token cannot be trusted is
+	// refused, unless format 'always' is about to overwrite it anyway.
+	isLuks := dm.ops.IsLuks(devicePath)
+	always := disk.Config.Format == "always"
 	if isLuks {
-		disk.Initialized = IsInitialized(devicePath)
+		disk.Initialized, err = dm.isInitialized(devicePath)
+		if err != nil {
+			if !always {
+				return fmt.Errorf("refusing disk %s: %w", name, err)
+			}
+			log.Printf("Ignoring init token of disk %s, format is always: %v", name, err)
+		}
 		log.Printf("Found existing LUKS container on %s (initialized: %v)", devicePath, disk.Initialized)
+		if phase := dm.formatPhase(disk); phase != "" {
+			log.Printf("Disk %s was left partly formatted, formatting stopped after phase %s", name, phase)
+		}
+
+		if disk.Initialized && !always {
+			if err := dm.verifyOwner(disk); err != nil {
+				return fmt.Errorf("refusing disk %s: %w", name, err)
+			}
+			if err := dm.verifyIdentity(devicePath); err != nil {
+				return fmt.Errorf("refusing disk %s: %w", name, err)
+			}
+			if err := dm.verifyEncryption(disk); err != nil {
+				return fmt.Errorf("refusing disk %s: %w", name, err)
+			}
+		}
 	}
 
 	// Determine if we should format
@@ -75,7 +123,10 @@ func (dm *Manager) SetupDisk(ctx context.Context, name string) error {
 		}
 	} else if isLuks {
 		if err := dm.mountExistingDisk(ctx, disk); err != nil {
-			if disk.Config.Format == "on_fail" {
+			// A key the TPM refuses to unseal still exists, and a disk with
+			// a recovery key can still be opened by the operators;
+			// reformatting would destroy data that is not lost.
+			if disk.Config.Format == "on_fail" && !errors.Is(err, tpm.ErrUnsealFailed) && !errors.Is(err, errNeedsRecovery) {
 				log.Printf("Failed to mount existing disk %s, reformatting: %v", name, err)
 				if err := dm.formatDisk(ctx, disk); err != nil {
 					return fmt.Errorf("failed to format disk %s after mount failure: %w", name, err)
@@ -114,90 +165,152 @@ func (dm *Manager) GetDisk(name string) (*ManagedDisk, bool) {
 	return disk, ok
 }
 
-func (dm *Manager) findDevice(cfg config.DiskConfig) (string, error) {
-	finder, err := CreateDiskFinder(cfg)
+// LocateDisk resolves the device of a disk outside of SetupDisk, e.g. after
+// boot. An open mapping is trusted over the finder, which may pick a
+// different device once disks have been added.
+func (dm *Manager) LocateDisk(name string) (*ManagedDisk, error) {
+	disk, ok := dm.disks[name]
+	if !ok {
+		return nil, fmt.Errorf("disk %s not found", name)
+	}
+
+	if disk.DevicePath != "" {
+		return disk, nil
+	}
+
+	status, err := dm.ops.LuksStatus(disk.MapperName)
+	if err == nil {
+		disk.DevicePath = status.Device
+		return disk, nil
+	}
+
+	finder, err := dm.newFinder(name, disk.Config)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return finder.Find()
+	devicePath, err := finder.Find()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find device for disk %s: %w", name, err)
+	}
+	disk.DevicePath = devicePath
+
+	return disk, nil
 }
 
-func (dm *Manager) shouldFormat(disk *ManagedDisk, isLuks bool) bool {
-	switch disk.Config.Format {
-	case "always":
-		return true
-	case "never":
-		return false
-	case "on_initialize":
-		if !isLuks {
-			// No LUKS means uninitialized, format if encryption is requested
-			return disk.Config.EncryptionKey != ""
-		}
-		// Has LUKS, only format if not initialized
-		return !disk.Initialized
-	default:
-		return false
+// findDevice runs the disk's finder. An array or partition that does not
+// exist yet is created unless the format strategy forbids writing to the
+// disks.
+func (dm *Manager) findDevice(disk *ManagedDisk) (string, error) {
+	finder, err := dm.newFinder(disk.Name, disk.Config)
+	if err != nil {
+		return "", err
 	}
-}
 
-func (dm *Manager) formatDisk(ctx context.Context, disk *ManagedDisk) error {
-	if disk.Config.EncryptionKey == "" {
-		return dm.formatPlainDisk(disk)
+	devicePath, err := finder.Find()
+	if err == nil || disk.Config.Format == "never" {
+		return devicePath, err
 	}
 
-	// Get encryption passphrase
-	passphrase, err := dm.keyManager.GetKey(ctx, disk.Config.EncryptionKey)
+	switch f := finder.(type) {
+	case *RaidFinder:
+		if errors.Is(err, errArrayNotFound) {
+			return f.Create()
+		}
+	case *PartitionFinder:
+		if errors.Is(err, errPartitionNotFound) {
+			return f.Create()
+		}
+	}
+	return devicePath, err
+}
+
+// verifyOwner checks that the init token was written for this disk entry,
+// so a disk another entry's finder lands on is neither opened with the
+// wrong key nor reformatted.
+func (dm *Manager) verifyOwner(disk *ManagedDisk) error {
+	data, err := dm.initToken(disk.DevicePath)
 	if err != nil {
-		return fmt.Errorf("failed to get encryption key: %w", err)
+		return err
+	}
+	if owner := data["disk_name"]; owner != disk.Name {
+		return fmt.Errorf("%s was initialized for disk %s", disk.DevicePath, owner)
 	}
+	return nil
+}
 
-	// Format with LUKS
-	if err := FormatLuks(disk.DevicePath, passphrase); err != nil {
+// verifyIdentity checks that the disk is the one its init token was
+// written for, so a LUKS header copied onto another disk is not trusted.
+func (dm *Manager) verifyIdentity(devicePath string) error {
+	recorded, err := dm.initIdentity(devicePath)
+	if err != nil {
 		return err
 	}
 
-	// Store initialization token
-	if err := StoreInitToken(disk.DevicePath, disk.Name); err != nil {
-		log.Printf("Warning: Failed to store init token: %v", err)
+	if mismatch := recorded.Mismatch(ReadDiskIdentity(devicePath)); mismatch != "" {
+		return fmt.Errorf("device %s does not match its init token: %s", devicePath, mismatch)
 	}
+	return nil
+}
 
-	// Open LUKS device
-	if err := OpenLuks(disk.DevicePath, disk.MapperName, passphrase); err != nil {
+// verifyEncryption checks the header's encryption settings against those
+// recorded at format time. Settings in the config only apply when
+// formatting, so differences from them are logged, not enforced.
+func (dm *Manager) verifyEncryption(disk *ManagedDisk) error {
+	actual, err := dm.ops.LuksParams(disk.DevicePath)
+	if err != nil {
 		return err
 	}
 
-	// Create filesystem
-	if err := CreateFilesystem(disk.MapperDevice); err != nil {
-		CloseLuks(disk.MapperName)
+	recorded, err := dm.initLuksParams(disk.DevicePath)
+	if err != nil {
 		return err
 	}
 
-	// Mount the device
-	if err := MountDevice(disk.MapperDevice, disk.Config.MountAt); err != nil {
-		CloseLuks(disk.MapperName)
-		return fmt.Errorf("failed to mount: %w", err)
+	if mismatch := recorded.Mismatch(actual); mismatch != "" {
+		return fmt.Errorf("LUKS header of %s does not match its init token: %s", disk.DevicePath, mismatch)
 	}
 
-	// Create subdirectories
-	if err := CreateMountDirs(disk.Config.MountAt, []string{"ssh", "data", "logs"}); err != nil {
-		log.Printf("Warning: Failed to create subdirectories: %v", err)
+	if differs := actual.Differs(disk.Config.LUKS); differs != "" {
+		log.Printf("Warning: Disk %s was formatted with %s", disk.Name, differs)
 	}
-
-	disk.Initialized = true
-	log.Printf("Successfully formatted and mounted encrypted disk %s", disk.Name)
 	return nil
 }
 
+func (dm *Manager) shouldFormat(disk *ManagedDisk, isLuks bool) bool {
+	switch disk.Config.Format {
+	case "always":
+		return true
+	case "never":
+		return false
+	case "on_initialize":
+		if !isLuks {
+			// No LUKS means uninitialized, format if encryption is requested
+			return disk.Config.EncryptionKey != ""
+		}
+		// Has LUKS, only format if not initialized
+		return !disk.Initialized
+	case "on_fail":
+		// A format interrupted by a crash is completed rather than opened
+		return isLuks && !disk.Initialized && dm.formatPhase(disk) != ""
+	default:
+		return false
+	}
+}
+
 func (dm *Manager) formatPlainDisk(disk *ManagedDisk) error {
+	if err := dm.checkWipe(disk); err != nil {
+		return err
+	}
+
 	log.Printf("Formatting plain disk %s", disk.DevicePath)
 
 	// Create filesystem
-	if err := CreateFilesystem(disk.DevicePath); err != nil {
+	if err := dm.createFilesystem(disk, disk.DevicePath); err != nil {
 		return err
 	}
 
 	// Mount the device
-	if err := MountDevice(disk.DevicePath, disk.Config.MountAt); err != nil {
+	if err := dm.mount(disk, disk.DevicePath, disk.Config.FSType); err != nil {
 		return err
 	}
 
@@ -224,29 +337,93 @@ func (dm *Manager) mountExistingDisk(ctx context.Context, disk *ManagedDisk) err
 
 	log.Printf("Opening existing LUKS device %s", disk.DevicePath)
 
+	if dm.hasRecoveryKey(disk.DevicePath) {
+		if _, err := dm.ops.LuksKeyslot(disk.DevicePath, passphrase); err != nil {
+			return fmt.Errorf("key %s rejected: %w", disk.Config.EncryptionKey, errNeedsRecovery)
+		}
+	}
+
 	// Open LUKS device
-	if err := OpenLuks(disk.DevicePath, disk.MapperName, passphrase); err != nil {
+	if err := dm.ops.LuksOpen(disk.DevicePath, disk.MapperName, passphrase); err != nil {
 		return err
 	}
 
-	// Mount the device
-	if err := MountDevice(disk.MapperDevice, disk.Config.MountAt); err != nil {
-		CloseLuks(disk.MapperName)
+	// Mount the device with the filesystem it actually has
+	fsType := dm.existingFilesystem(disk, disk.MapperDevice)
+	if err := dm.mount(disk, disk.MapperDevice, fsType); err != nil {
+		dm.ops.LuksClose(disk.MapperName)
 		return fmt.Errorf("failed to mount: %w", err)
 	}
 
 	log.Printf("Successfully mounted existing encrypted disk %s", disk.Name)
+
+	if disk.Initialized {
+		if err := dm.migrateInitToken(disk, passphrase, fsType); err != nil {
+			log.Printf("Warning: Failed to migrate init token of disk %s: %v", disk.Name, err)
+		}
+	}
+
+	// Use space added to the disk since the last boot
+	if _, err := dm.growLuks(disk, passphrase); err != nil {
+		log.Printf("Warning: Failed to grow LUKS mapping of disk %s: %v", disk.Name, err)
+	} else {
+		dm.growFilesystem(disk, disk.MapperDevice, fsType)
+	}
+
 	return nil
 }
 
 func (dm *Manager) mountPlainDisk(disk *ManagedDisk) error {
 	log.Printf("Mounting plain disk %s", disk.DevicePath)
 
-	// Mount the device
-	if err := MountDevice(disk.DevicePath, disk.Config.MountAt); err != nil {
+	// Mount the device with the filesystem it actually has
+	fsType := dm.existingFilesystem(disk, disk.DevicePath)
+	if err := dm.mount(disk, disk.DevicePath, fsType); err != nil {
 		return err
 	}
 
 	log.Printf("Successfully mounted plain disk %s", disk.Name)
+
+	// Use space added to the disk since the last boot
+	dm.growFilesystem(disk, disk.DevicePath, fsType)
+
 	return nil
 }
+
+func (dm *Manager) createFilesystem(disk *ManagedDisk, device string) error {
+	log.Printf("Creating %s filesystem on %s", disk.Config.FSType, device)
+	return dm.ops.Mkfs(device, disk.Config.FSType, disk.Config.MkfsOptions)
+}
+
+func (dm *Manager) mount(disk *ManagedDisk, device, fsType string) error {
+	if dm.ops.IsMounted(disk.Config.MountAt) {
+		log.Printf("Device already mounted at %s", disk.Config.MountAt)
+		return nil
+	}
+	return dm.ops.Mount(device, disk.Config.MountAt, fsType, disk.Config.MountOptions)
+}
+
+// existingFilesystem detects the filesystem on device. fs_type only applies
+// when formatting, so a disk formatted with another type keeps it.
+func (dm *Manager) existingFilesystem(disk *ManagedDisk, device string) string {
+	fsType := dm.ops.FilesystemType(device)
+	if fsType != "" && fsType != disk.Config.FSType {
+		log.Printf("Disk %s has a %s filesystem, fs_type %s only applies when formatting", disk.Name, fsType, disk.Config.FSType)
+	}
+	return fsType
+}
+
+func (dm *Manager) growFilesystem(disk *ManagedDisk, device, fsType string) {
+	if fsType == "" {
+		return
+	}
+
+	grown, err := dm.resizeFilesystem(disk, device, fsType)
+	if err != nil {
+		log.Printf("Warning: Failed to grow filesystem of disk %s: %v", disk.Name, err)
+		return
+	}
+	if grown {
+		log.Printf("Grew filesystem of disk %s to fill %s", disk.Name, device)
+	}
+}
@@ -0,0 +1,318 @@
+package disks
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/keys"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
+)
+
+const (
+	testDisk   = "data"
+	testDevice = "/dev/sdb"
+	testSize   = 1 << 30
+)
+
+// testKey is a key provider whose key, or failure, the test controls.
+type testKey struct {
+	key string
+	err error
+}
+
+func (k *testKey) Get(ctx context.Context) (string, error) {
+	return k.key, k.err
+}
+
+func (k *testKey) Store(key string) error {
+	k.key = key
+	return nil
+}
+
+type testDiskOptions struct {
+	format   string
+	recovery bool
+}
+
+// newTestManager returns a Manager for a single disk on ops, using key as
+// its encryption key unless the disk is ephemeral.
+func newTestManager(t *testing.T, ops *FakeBlockOps, key keys.Provider, opts testDiskOptions) *Manager {
+	t.Helper()
+
+	disk := config.DiskConfig{
+		Strategy:      "largest",
+		Format:        opts.format,
+		EncryptionKey: "key",
+		MountAt:       t.TempDir(),
+	}
+	if opts.format == "ephemeral" {
+		disk.EncryptionKey = ""
+	}
+	if opts.recovery {
+		operator, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disk.Recovery = &config.RecoveryConfig{
+			OperatorKeys: []string{base64.StdEncoding.EncodeToString(operator.PublicKey().Bytes())},
+		}
+	}
+
+	cfg := &config.Config{
+		SSH:   config.SSHConfig{Strategy: "webserver", Dir: t.TempDir()},
+		Keys:  map[string]config.KeyConfig{"key": {Strategy: "random"}},
+		Disks: map[string]config.DiskConfig{testDisk: disk},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+
+	km := keys.NewManagerWithProviders(map[string]keys.Provider{"key": key})
+	dm, err := NewManagerWithOps(cfg, km, ops, ops.Finder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dm
+}
+
+// formatTestDisk formats the disk on a first boot, then reboots.
+func formatTestDisk(t *testing.T, ops *FakeBlockOps, key *testKey, recovery bool) {
+	t.Helper()
+	dm := newTestManager(t, ops, key, testDiskOptions{format: "on_initialize", recovery: recovery})
+	if err := dm.SetupDisk(context.Background(), testDisk); err != nil {
+		t.Fatalf("first boot: %v", err)
+	}
+	ops.Reboot()
+}
+
+// diskStates prepare the device and key a boot starts with.
+var diskStates = []struct {
+	name    string
+	prepare func(t *testing.T, ops *FakeBlockOps, key *testKey)
+}{
+	{"blank", func(t *testing.T, ops *FakeBlockOps, key *testKey) {}},
+	{"partly formatted", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		ops.FailOn["Mkfs"] = errors.New("mkfs failed")
+		dm := newTestManager(t, ops, key, testDiskOptions{format: "on_initialize"})
+		if err := dm.SetupDisk(context.Background(), testDisk); err == nil {
+			t.Fatal("first boot succeeded, want mkfs failure")
+		}
+		delete(ops.FailOn, "Mkfs")
+		ops.Reboot()
+	}},
+	{"initialized", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		formatTestDisk(t, ops, key, false)
+	}},
+	{"initialized by another disk", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		formatTestDisk(t, ops, key, false)
+		ops.Devices[testDevice].Tokens[InitTokenID].UserData["disk_name"] = "other"
+	}},
+	{"newer token schema", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		formatTestDisk(t, ops, key, false)
+		ops.Devices[testDevice].Tokens[InitTokenID].UserData["schema"] = "99"
+	}},
+	{"ephemeral from last boot", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		dm := newTestManager(t, ops, key, testDiskOptions{format: "ephemeral"})
+		if err := dm.SetupDisk(context.Background(), testDisk); err != nil {
+			t.Fatalf("first boot: %v", err)
+		}
+		ops.Reboot()
+	}},
+	{"plain filesystem", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		if err := ops.Mkfs(testDevice, "ext4", nil); err != nil {
+			t.Fatal(err)
+		}
+	}},
+	{"foreign LUKS", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		if err := ops.LuksFormat(testDevice, "someone else's key", nil); err != nil {
+			t.Fatal(err)
+		}
+	}},
+	{"unseal failure", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		formatTestDisk(t, ops, key, false)
+		key.err = fmt.Errorf("failed to retrieve key from TPM: %w", tpm.ErrUnsealFailed)
+	}},
+	{"key rejected", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		formatTestDisk(t, ops, key, false)
+		key.key = "key after TPM reset"
+	}},
+	{"recovery needed", func(t *testing.T, ops *FakeBlockOps, key *testKey) {
+		formatTestDisk(t, ops, key, true)
+		key.key = "key after TPM reset"
+	}},
+}
+
+const (
+	mounted   = "mounted"
+	formatted = "formatted"
+)
+
+func TestSetupDisk(t *testing.T) {
+	// want maps a disk state to "mounted" (existing data kept),
+	// "formatted" (new filesystem mounted) or a substring of the error.
+	tests := []struct {
+		format string
+		want   map[string]string
+	}{
+		{"always", map[string]string{
+			"blank":                       formatted,
+			"partly formatted":            formatted,
+			"initialized":                 formatted,
+			"initialized by another disk": formatted,
+			"newer token schema":          formatted,
+			"ephemeral from last boot":    formatted,
+			"plain filesystem":            formatted,
+			"foreign LUKS":                formatted,
+			"unseal failure":              "TPM refused to unseal",
+			"key rejected":                formatted,
+			"recovery needed":             formatted,
+		}},
+		{"on_initialize", map[string]string{
+			"blank":                       formatted,
+			"partly formatted":            formatted,
+			"initialized":                 mounted,
+			"initialized by another disk": "was initialized for disk other",
+			"newer token schema":          "refusing disk data",
+			"ephemeral from last boot":    formatted,
+			"plain filesystem":            "holds data not written by tdx-init (ext4 at 0x0)",
+			"foreign LUKS":                "holds data not written by tdx-init (LUKS2 at 0x0)",
+			"unseal failure":              "TPM refused to unseal",
+			"key rejected":                "no key available with this passphrase",
+			"recovery needed":             "run 'tdx-init recover disk'",
+		}},
+		{"on_fail", map[string]string{
+			"blank":                       formatted,
+			"partly formatted":            formatted,
+			"initialized":                 mounted,
+			"initialized by another disk": "was initialized for disk other",
+			"newer token schema":          "refusing disk data",
+			"ephemeral from last boot":    formatted,
+			"plain filesystem":            "holds data not written by tdx-init (ext4 at 0x0)",
+			"foreign LUKS":                "holds data not written by tdx-init (LUKS2 at 0x0)",
+			"unseal failure":              "TPM refused to unseal",
+			"key rejected":                formatted,
+			"recovery needed":             "run 'tdx-init recover disk'",
+		}},
+		{"never", map[string]string{
+			"blank":                       "format strategy prevents it",
+			"partly formatted":            "no filesystem",
+			"initialized":                 mounted,
+			"initialized by another disk": "was initialized for disk other",
+			"newer token schema":          "refusing disk data",
+			"ephemeral from last boot":    "format strategy prevents it",
+			"plain filesystem":            "format strategy prevents it",
+			"foreign LUKS":                "no key available with this passphrase",
+			"unseal failure":              "TPM refused to unseal",
+			"key rejected":                "no key available with this passphrase",
+			"recovery needed":             "run 'tdx-init recover disk'",
+		}},
+		{"ephemeral", map[string]string{
+			"blank":                       formatted,
+			"partly formatted":            "as an ephemeral disk, it holds data (LUKS2 at 0x0)",
+			"initialized":                 "as an ephemeral disk, it holds data (LUKS2 at 0x0)",
+			"initialized by another disk": "as an ephemeral disk, it holds data (LUKS2 at 0x0)",
+			"newer token schema":          "as an ephemeral disk, it holds data (LUKS2 at 0x0)",
+			"ephemeral from last boot":    formatted,
+			"plain filesystem":            "as an ephemeral disk, it holds data (ext4 at 0x0)",
+			"foreign LUKS":                "as an ephemeral disk, it holds data (LUKS2 at 0x0)",
+			"unseal failure":              "as an ephemeral disk, it holds data (LUKS2 at 0x0)",
+			"key rejected":                "as an ephemeral disk, it holds data (LUKS2 at 0x0)",
+			"recovery needed":             "as an ephemeral disk, it holds data (LUKS2 at 0x0)",
+		}},
+	}
+
+	for _, tt := range tests {
+		for _, state := range diskStates {
+			want, ok := tt.want[state.name]
+			if !ok {
+				t.Fatalf("format %s: no expectation for state %s", tt.format, state.name)
+			}
+
+			t.Run(tt.format+"/"+state.name, func(t *testing.T) {
+				ops := NewFakeBlockOps()
+				ops.AddDisk(testDisk, testDevice, testSize)
+				key := &testKey{key: "disk key"}
+				state.prepare(t, ops, key)
+				ops.Calls = nil
+
+				dm := newTestManager(t, ops, key, testDiskOptions{format: tt.format})
+				err := dm.SetupDisk(context.Background(), testDisk)
+				disk, _ := dm.GetDisk(testDisk)
+				mountedDevice := ops.Mounts[disk.Config.MountAt]
+
+				switch want {
+				case mounted, formatted:
+					if err != nil {
+						t.Fatalf("SetupDisk: %v", err)
+					}
+					if mountedDevice != disk.MapperDevice {
+						t.Fatalf("mounted %q at %s, want %s", mountedDevice, disk.Config.MountAt, disk.MapperDevice)
+					}
+					if got := formattedBy(ops.Calls); (got != "") != (want == formatted) {
+						t.Fatalf("formatted = %v (%s), want %v", got != "", got, want == formatted)
+					}
+				default:
+					if err == nil {
+						t.Fatalf("SetupDisk succeeded, want error containing %q", want)
+					}
+					if !strings.Contains(err.Error(), want) {
+						t.Fatalf("SetupDisk error = %v, want %q", err, want)
+					}
+					if mountedDevice != "" {
+						t.Fatalf("left %s mounted after error", mountedDevice)
+					}
+					if _, ok := ops.mappings[disk.MapperName]; ok {
+						t.Fatalf("left mapping %s open after error", disk.MapperName)
+					}
+					if got := formattedBy(ops.Calls); got != "" {
+						t.Fatalf("formatted (%s) and then failed", got)
+					}
+				}
+			})
+		}
+	}
+}
+
+// formattedBy returns the first call that destroyed the disk's contents.
+func formattedBy(calls []string) string {
+	for _, call := range calls {
+		if strings.HasPrefix(call, "LuksFormat ") || strings.HasPrefix(call, "PlainOpen ") ||
+			strings.HasPrefix(call, "Mkfs "+testDevice) {
+			return call
+		}
+	}
+	return ""
+}
+
+func TestSetupDiskMigratesSchema1Token(t *testing.T) {
+	ops := NewFakeBlockOps()
+	ops.AddDisk(testDisk, testDevice, testSize)
+	key := &testKey{key: "disk key"}
+	formatTestDisk(t, ops, key, false)
+
+	token := ops.Devices[testDevice].Tokens[InitTokenID]
+	token.UserData = map[string]string{"initialized": "true", "disk_name": testDisk}
+
+	for boot := 1; boot <= 2; boot++ {
+		dm := newTestManager(t, ops, key, testDiskOptions{format: "on_initialize"})
+		if err := dm.SetupDisk(context.Background(), testDisk); err != nil {
+			t.Fatalf("boot %d: %v", boot, err)
+		}
+		ops.Reboot()
+	}
+
+	data := ops.Devices[testDevice].Tokens[InitTokenID].UserData
+	if data["schema"] != "2" || data["migrated_from"] != "1" {
+		t.Fatalf("token schema %q migrated from %q, want 2 from 1", data["schema"], data["migrated_from"])
+	}
+	if created, ok := data["created_at"]; ok {
+		t.Fatalf("migrated token claims created_at %s", created)
+	}
+}
@@ -0,0 +1,186 @@
+package disks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+)
+
+var errPartitionNotFound = errors.New("partition not found")
+
+// PartitionSpec is one entry of a GPT layout. An empty Size takes the rest
+// of the disk.
+type PartitionSpec struct {
+	Label string
+	Size  string
+}
+
+// PartitionFinder selects a GPT partition by name (PARTLABEL) and/or
+// PARTUUID. With a layout it can create the whole partition table on a
+// blank disk found by Disk; see Create.
+type PartitionFinder struct {
+	Label            string
+	UUID             string
+	Disk             DiskFinder
+	Layout           []PartitionSpec
+	AllowWipeForeign bool
+}
+
+func NewPartitionFinder(name string, cfg map[string]interface{}) (*PartitionFinder, error) {
+	f := &PartitionFinder{}
+	f.Label, _ = cfg["label"].(string)
+	f.UUID, _ = cfg["uuid"].(string)
+
+	if diskCfg, ok := cfg["disk"].(map[string]interface{}); ok {
+		strategy, _ := diskCfg["strategy"].(string)
+		strategyConfig, _ := diskCfg["strategy_config"].(map[string]interface{})
+		finder, err := CreateDiskFinder(name, config.DiskConfig{Strategy: strategy, StrategyConfig: strategyConfig})
+		if err != nil {
+			return nil, fmt.Errorf("partition disk: %w", err)
+		}
+		f.Disk = finder
+	}
+
+	if layout, ok := cfg["layout"].([]interface{}); ok {
+		for _, entry := range layout {
+			spec, _ := entry.(map[string]interface{})
+			label, _ := spec["label"].(string)
+			size := ""
+			if value, ok := spec["size"]; ok {
+				size = fmt.Sprint(value)
+			}
+			f.Layout = append(f.Layout, PartitionSpec{Label: label, Size: size})
+		}
+	}
+
+	return f, nil
+}
+
+// Find returns the partition if it exists. It never partitions a disk; see
+// Create.
+func (f *PartitionFinder) Find() (string, error) {
+	var byUUID, byLabel string
+
+	if f.UUID != "" {
+		if device, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-partuuid", strings.ToLower(f.UUID))); err == nil {
+			byUUID = device
+		}
+	}
+
+	if f.Label != "" {
+		matches := partitionsByLabel(f.Label)
+		if len(matches) > 1 {
+			return "", fmt.Errorf("partition label %s matches %d partitions: %s", f.Label, len(matches), strings.Join(matches, ", "))
+		}
+		if len(matches) == 1 {
+			byLabel = matches[0]
+		}
+	}
+
+	device := byUUID
+	switch {
+	case byUUID == "" && byLabel == "":
+		return "", errPartitionNotFound
+	case f.UUID != "" && f.Label != "" && byUUID != byLabel:
+		return "", fmt.Errorf("partition UUID %s and label %s do not resolve to the same partition", f.UUID, f.Label)
+	case byUUID == "":
+		device = byLabel
+	}
+
+	if isBootDevice(device) {
+		return "", fmt.Errorf("partition %s is the boot device", device)
+	}
+	return device, nil
+}
+
+// Create writes the layout as a new GPT to the disk found by Disk and
+// returns the configured partition. The disk must be blank unless
+// AllowWipeForeign is set. Every partition of the layout is created, so
+// other disks sharing the layout find theirs afterwards.
+func (f *PartitionFinder) Create() (string, error) {
+	disk, err := f.blankDisk()
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Creating GPT on %s with %s", disk, f.describeLayout())
+
+	var script strings.Builder
+	script.WriteString("label: gpt\n")
+	for _, spec := range f.Layout {
+		if spec.Size != "" {
+			fmt.Fprintf(&script, "size=%s, ", spec.Size)
+		}
+		fmt.Fprintf(&script, "name=%q\n", spec.Label)
+	}
+
+	cmd := exec.Command("sfdisk", "--wipe", "always", "--wipe-partitions", "always", disk)
+	cmd.Stdin = strings.NewReader(script.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to partition %s: %s: %w", disk, strings.TrimSpace(string(output)), err)
+	}
+
+	// Wait for udev to create the device nodes of the new partitions
+	exec.Command("udevadm", "settle").Run()
+
+	return f.Find()
+}
+
+// blankDisk finds the disk to partition and checks that it may be.
+func (f *PartitionFinder) blankDisk() (string, error) {
+	if len(f.Layout) == 0 || f.Disk == nil {
+		return "", fmt.Errorf("no partition labelled %s and no layout to create it", f.Label)
+	}
+
+	disk, err := f.Disk.Find()
+	if err != nil {
+		return "", fmt.Errorf("failed to find disk to partition: %w", err)
+	}
+
+	if !f.AllowWipeForeign && !isUnusedDisk(disk) {
+		return "", fmt.Errorf("refusing to partition %s, it is in use or holds data; set allow_wipe_foreign to partition it anyway", disk)
+	}
+	return disk, nil
+}
+
+func (f *PartitionFinder) describeLayout() string {
+	parts := make([]string, len(f.Layout))
+	for i, spec := range f.Layout {
+		size := spec.Size
+		if size == "" {
+			size = "rest of disk"
+		}
+		parts[i] = fmt.Sprintf("%s (%s)", spec.Label, size)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// partitionsByLabel scans sysfs for partitions whose GPT name is label. The
+// kernel reports it as PARTNAME in the uevent, so this works before udev
+// has created the by-partlabel links and notices duplicate names.
+func partitionsByLabel(label string) []string {
+	entries, err := os.ReadDir("/sys/class/block")
+	if err != nil {
+		return nil
+	}
+
+	var matches []string
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join("/sys/class/block", entry.Name(), "uevent"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if name, ok := strings.CutPrefix(line, "PARTNAME="); ok && name == label {
+				matches = append(matches, "/dev/"+entry.Name())
+			}
+		}
+	}
+	return matches
+}
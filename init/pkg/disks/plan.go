@@ -0,0 +1,307 @@
+package disks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiskPlan describes what SetupDisk would do to a disk. Formats is true
+// when the disk would be formatted, so nothing stored on it survives.
+type DiskPlan struct {
+	Name       string
+	DevicePath string
+	Actions    []string
+	Formats    bool
+	// Err is why SetupDisk would fail before changing the disk.
+	Err error
+}
+
+func (p *DiskPlan) add(format string, args ...interface{}) {
+	p.Actions = append(p.Actions, fmt.Sprintf(format, args...))
+}
+
+// PlanDisk runs the finder, LUKS detection and init token checks of
+// SetupDisk and records the steps it would take, without writing to any
+// device. Arrays are neither assembled nor created.
+func (dm *Manager) PlanDisk(name string) *DiskPlan {
+	plan := &DiskPlan{Name: name}
+
+	disk, ok := dm.disks[name]
+	if !ok {
+		plan.Err = fmt.Errorf("disk %s not found", name)
+		return plan
+	}
+
+	finder, err := dm.newFinder(name, disk.Config)
+	if err != nil {
+		plan.Err = err
+		return plan
+	}
+
+	if raid, ok := finder.(*RaidFinder); ok {
+		if _, err := os.Stat(raid.ArrayPath()); err != nil {
+			dm.planArray(disk, raid, plan)
+			return plan
+		}
+	}
+
+	if partition, ok := finder.(*PartitionFinder); ok {
+		if _, err := partition.Find(); errors.Is(err, errPartitionNotFound) {
+			dm.planPartition(disk, partition, plan)
+			return plan
+		}
+	}
+
+	devicePath, err := finder.Find()
+	if err != nil {
+		plan.Err = fmt.Errorf("failed to find device for disk %s: %w", name, err)
+		return plan
+	}
+	disk.DevicePath = devicePath
+	plan.DevicePath = devicePath
+
+	if disk.Config.Format == "ephemeral" {
+		dm.planEphemeral(disk, plan)
+		return plan
+	}
+
+	isLuks := dm.ops.IsLuks(devicePath)
+	always := disk.Config.Format == "always"
+	if isLuks {
+		disk.Initialized, err = dm.isInitialized(devicePath)
+		if err != nil {
+			if !always {
+				plan.Err = fmt.Errorf("refusing disk %s: %w", name, err)
+				return plan
+			}
+			plan.add("ignore init token, format is always: %v", err)
+		}
+		plan.add("found LUKS container (initialized: %v)", disk.Initialized)
+		if disk.Initialized {
+			dm.planInitToken(devicePath, plan)
+		} else if phase := dm.formatPhase(disk); phase != "" {
+			plan.add("left partly formatted, formatting stopped after phase %s", phase)
+		}
+
+		if disk.Initialized && !always {
+			if err := dm.verifyOwner(disk); err != nil {
+				plan.Err = fmt.Errorf("refusing disk %s: %w", name, err)
+				return plan
+			}
+			if err := dm.verifyIdentity(devicePath); err != nil {
+				plan.Err = fmt.Errorf("refusing disk %s: %w", name, err)
+				return plan
+			}
+			if err := dm.verifyEncryption(disk); err != nil {
+				plan.Err = fmt.Errorf("refusing disk %s: %w", name, err)
+				return plan
+			}
+		}
+	}
+
+	dm.planSetup(disk, isLuks, plan)
+	return plan
+}
+
+// planSetup follows the same decisions as SetupDisk.
+func (dm *Manager) planSetup(disk *ManagedDisk, isLuks bool, plan *DiskPlan) {
+	switch {
+	case disk.Config.Format == "ephemeral":
+		dm.planEphemeral(disk, plan)
+	case dm.shouldFormat(disk, isLuks):
+		dm.planFormat(disk, plan)
+	case isLuks:
+		dm.planOpen(disk, plan)
+	case disk.Config.EncryptionKey == "":
+		dm.planPlain(disk, plan)
+	case disk.Config.Format == "on_fail":
+		plan.add("no LUKS container")
+		dm.planFormat(disk, plan)
+	default:
+		plan.Err = fmt.Errorf("disk %s requires formatting but format strategy prevents it", disk.Name)
+	}
+}
+
+func (dm *Manager) planInitToken(devicePath string, plan *DiskPlan) {
+	data, err := dm.initToken(devicePath)
+	if err != nil {
+		return
+	}
+	if data["schema"] == "" {
+		plan.add("init token uses schema 1, migrate it to schema %d after opening", initTokenSchema)
+		return
+	}
+	if from, ok := data["migrated_from"]; ok {
+		plan.add("init token migrated from schema %s at %s, format details unknown", from, data["migrated_at"])
+		return
+	}
+	plan.add("formatted %s by tdx-init %s with a %s key", data["created_at"], data["tdx_init_version"], data["key_strategy"])
+}
+
+func (dm *Manager) planArray(disk *ManagedDisk, raid *RaidFinder, plan *DiskPlan) {
+	candidates, err := raid.candidates()
+	if err != nil {
+		plan.Err = err
+		return
+	}
+
+	var members []string
+	for _, device := range candidates {
+		if raid.isMember(device) {
+			members = append(members, device)
+		}
+	}
+	plan.DevicePath = raid.ArrayPath()
+
+	if len(members) > 0 {
+		plan.add("assemble array %s from %s", raid.Name, strings.Join(members, ", "))
+		plan.add("then inspect the assembled array; its LUKS state cannot be read before assembly")
+		return
+	}
+
+	if disk.Config.Format == "never" {
+		plan.Err = fmt.Errorf("failed to find device for disk %s: %w", disk.Name, errArrayNotFound)
+		return
+	}
+
+	devices, err := raid.newMembers(candidates)
+	if err != nil {
+		plan.Err = err
+		return
+	}
+	if len(devices) < raid.MinDevices {
+		plan.Err = fmt.Errorf("array %s needs at least %d disks, found %d", raid.Name, raid.MinDevices, len(devices))
+		return
+	}
+
+	plan.add("create %s array %s from %s", raid.Level, raid.Name, strings.Join(devices, ", "))
+	dm.planSetup(disk, false, plan)
+}
+
+func (dm *Manager) planPartition(disk *ManagedDisk, partition *PartitionFinder, plan *DiskPlan) {
+	if disk.Config.Format == "never" {
+		plan.Err = fmt.Errorf("failed to find device for disk %s: %w", disk.Name, errPartitionNotFound)
+		return
+	}
+
+	device, err := partition.blankDisk()
+	if err != nil {
+		plan.Err = err
+		return
+	}
+	plan.DevicePath = filepath.Join("/dev/disk/by-partlabel", partition.Label)
+
+	plan.add("create GPT on %s with %s", device, partition.describeLayout())
+	dm.planSetup(disk, false, plan)
+}
+
+func (dm *Manager) planFormat(disk *ManagedDisk, plan *DiskPlan) {
+	// A new array does not exist yet and is blank once created.
+	if _, err := dm.ops.DeviceSize(plan.DevicePath); err == nil {
+		if err := dm.checkWipe(disk); err != nil {
+			plan.Err = err
+			return
+		}
+	}
+	plan.Formats = true
+
+	if disk.Config.EncryptionKey == "" {
+		plan.add("FORMAT %s with %s (destroys all data)", plan.DevicePath, disk.Config.FSType)
+	} else {
+		plan.add("FORMAT %s with LUKS2%s using a new key from %s (destroys all data)", plan.DevicePath, formatArgsNote(disk), disk.Config.EncryptionKey)
+		if disk.Config.Recovery != nil {
+			plan.add("add recovery keyslot, its key escrowed to %d operator key(s)", len(disk.Config.Recovery.OperatorKeys))
+		}
+		plan.add("open as %s", disk.MapperDevice)
+		plan.add("create %s filesystem", disk.Config.FSType)
+		dm.planMount(disk, plan, disk.Config.FSType)
+		plan.add("store init token, marking the disk initialized")
+		return
+	}
+	dm.planMount(disk, plan, disk.Config.FSType)
+}
+
+func (dm *Manager) planEphemeral(disk *ManagedDisk, plan *DiskPlan) {
+	if status, err := dm.ops.LuksStatus(disk.MapperName); err == nil && status.Device == plan.DevicePath {
+		plan.add("already open as %s", disk.MapperDevice)
+		dm.planMount(disk, plan, disk.Config.FSType)
+		return
+	}
+
+	// A new array does not exist yet and is blank once created.
+	if _, err := dm.ops.DeviceSize(plan.DevicePath); err == nil {
+		if err := dm.checkWipe(disk); err != nil {
+			plan.Err = err
+			return
+		}
+	}
+	plan.Formats = true
+
+	cipher, _ := ephemeralSettings(disk.Config.LUKS)
+	plan.add("ENCRYPT %s with plain dm-crypt (%s) under a new one-time key (destroys all data)", plan.DevicePath, cipher)
+	plan.add("create %s filesystem", disk.Config.FSType)
+	dm.planMount(disk, plan, disk.Config.FSType)
+}
+
+func (dm *Manager) planOpen(disk *ManagedDisk, plan *DiskPlan) {
+	plan.add("open LUKS container as %s using key %s", disk.MapperDevice, disk.Config.EncryptionKey)
+	plan.add("mount existing filesystem (type detected after opening)")
+	recoverable := dm.hasRecoveryKey(plan.DevicePath)
+	if recoverable {
+		plan.add("if the key is rejected: stop for 'tdx-init recover disk'")
+	}
+	if disk.Config.Format == "on_fail" {
+		if recoverable {
+			plan.add("if opening or mounting fails otherwise, except when the TPM refuses the key: FORMAT with LUKS2 (destroys all data)")
+		} else {
+			plan.add("if opening or mounting fails, except when the TPM refuses the key: FORMAT with LUKS2 (destroys all data)")
+		}
+	}
+	if params, err := dm.ops.LuksParams(plan.DevicePath); err == nil && params.Integrity != "" {
+		plan.add("grow filesystem if the LUKS mapping has grown (the mapping itself is not grown, it has dm-integrity)")
+	} else {
+		plan.add("grow LUKS mapping and filesystem if the disk has grown")
+	}
+}
+
+func (dm *Manager) planPlain(disk *ManagedDisk, plan *DiskPlan) {
+	fsType := dm.ops.FilesystemType(plan.DevicePath)
+	if fsType == "" {
+		plan.add("no filesystem found")
+		if disk.Config.Format == "on_fail" {
+			dm.planFormat(disk, plan)
+		} else {
+			plan.Err = fmt.Errorf("plain disk %s has no filesystem to mount", disk.Name)
+		}
+		return
+	}
+
+	dm.planMount(disk, plan, fsType)
+	if disk.Config.Format == "on_fail" {
+		if mayWipeForeign(disk.Config) {
+			plan.add("if mounting fails: FORMAT with %s (destroys all data)", disk.Config.FSType)
+		} else {
+			plan.add("if mounting fails: stop, allow_wipe_foreign is not set")
+		}
+	}
+	plan.add("grow filesystem if the disk has grown")
+}
+
+func (dm *Manager) planMount(disk *ManagedDisk, plan *DiskPlan, fsType string) {
+	if dm.ops.IsMounted(disk.Config.MountAt) {
+		plan.add("skip mount, %s is already mounted", disk.Config.MountAt)
+		return
+	}
+	plan.add("mount %s at %s", fsType, disk.Config.MountAt)
+}
+
+func formatArgsNote(disk *ManagedDisk) string {
+	args := luksFormatArgs(disk.Config.LUKS)
+	if len(args) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(args, " ") + ")"
+}
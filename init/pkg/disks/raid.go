@@ -0,0 +1,211 @@
+package disks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errArrayNotFound = errors.New("no existing array members found")
+
+// RaidFinder assembles several disks into an md array. Members are either
+// the listed identities or, without a list, every blank disk. On later boots
+// members are recognized by the array name in their md superblock.
+type RaidFinder struct {
+	Name       string
+	Level      string
+	Members    []*IdentityFinder
+	MinDevices int
+	// AllowWipeForeign lets Create use listed members that are not blank.
+	AllowWipeForeign bool
+}
+
+func NewRaidFinder(name string, cfg map[string]interface{}) *RaidFinder {
+	f := &RaidFinder{
+		Name:       name,
+		Level:      "raid0",
+		MinDevices: 2,
+	}
+	if level, ok := cfg["level"].(string); ok {
+		f.Level = level
+	}
+	if f.Level == "raid10" {
+		f.MinDevices = 4
+	}
+	if minDevices, ok := cfg["min_devices"].(int); ok {
+		f.MinDevices = minDevices
+	}
+	if devices, ok := cfg["devices"].([]interface{}); ok {
+		for _, device := range devices {
+			if identity, ok := device.(map[string]interface{}); ok {
+				f.Members = append(f.Members, NewIdentityFinder(identity))
+			}
+		}
+	}
+	return f
+}
+
+func (f *RaidFinder) ArrayPath() string {
+	return filepath.Join("/dev/md", f.Name)
+}
+
+// Find returns the array if it is already running or can be assembled from
+// existing members. It never creates one; see Create.
+func (f *RaidFinder) Find() (string, error) {
+	if _, err := os.Stat(f.ArrayPath()); err == nil {
+		return f.ArrayPath(), nil
+	}
+
+	candidates, err := f.candidates()
+	if err != nil {
+		return "", err
+	}
+
+	var members []string
+	for _, device := range candidates {
+		if f.isMember(device) {
+			members = append(members, device)
+		}
+	}
+	if len(members) == 0 {
+		return "", errArrayNotFound
+	}
+
+	log.Printf("Assembling array %s from %s", f.Name, strings.Join(members, ", "))
+	args := append([]string{"--assemble", f.ArrayPath(), "--run"}, members...)
+	if output, err := exec.Command("mdadm", args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to assemble array %s: %s: %w", f.Name, strings.TrimSpace(string(output)), err)
+	}
+
+	if degraded := readSysBlockAttr(filepath.Base(mdDevice(f.ArrayPath())), "md/degraded"); degraded != "" && degraded != "0" {
+		log.Printf("Warning: array %s is degraded (%s missing)", f.Name, degraded)
+	}
+
+	return f.ArrayPath(), nil
+}
+
+// Create builds a new array from the candidate disks. Listed members are
+// used as given; without a list only disks with no signatures, partitions
+// or holders are taken.
+func (f *RaidFinder) Create() (string, error) {
+	candidates, err := f.candidates()
+	if err != nil {
+		return "", err
+	}
+
+	members, err := f.newMembers(candidates)
+	if err != nil {
+		return "", err
+	}
+
+	if len(members) < f.MinDevices {
+		return "", fmt.Errorf("array %s needs at least %d disks, found %d", f.Name, f.MinDevices, len(members))
+	}
+
+	log.Printf("Creating %s array %s from %s", f.Level, f.Name, strings.Join(members, ", "))
+	args := []string{
+		"--create", f.ArrayPath(), "--run",
+		"--metadata=1.2",
+		"--level=" + f.Level,
+		"--raid-devices=" + strconv.Itoa(len(members)),
+		"--name=" + f.Name,
+	}
+	args = append(args, members...)
+	if output, err := exec.Command("mdadm", args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to create array %s: %s: %w", f.Name, strings.TrimSpace(string(output)), err)
+	}
+
+	return f.ArrayPath(), nil
+}
+
+// newMembers picks the disks for a new array. Without a member list the
+// blank candidates are used; listed members must be blank too unless
+// AllowWipeForeign is set.
+func (f *RaidFinder) newMembers(candidates []string) ([]string, error) {
+	if len(f.Members) > 0 {
+		if !f.AllowWipeForeign {
+			for _, device := range candidates {
+				if !isUnusedDisk(device) {
+					return nil, fmt.Errorf("refusing to create array %s, member %s is in use or holds data; set allow_wipe_foreign to use it anyway", f.Name, device)
+				}
+			}
+		}
+		return candidates, nil
+	}
+
+	var members []string
+	for _, device := range candidates {
+		if isUnusedDisk(device) {
+			members = append(members, device)
+		}
+	}
+	return members, nil
+}
+
+func (f *RaidFinder) candidates() ([]string, error) {
+	if len(f.Members) == 0 {
+		var devices []string
+		for _, device := range wholeDisks() {
+			if !isBootDevice(device) {
+				devices = append(devices, device)
+			}
+		}
+		return devices, nil
+	}
+
+	devices := make([]string, 0, len(f.Members))
+	for i, member := range f.Members {
+		device, err := member.Find()
+		if err != nil {
+			return nil, fmt.Errorf("array %s device %d: %w", f.Name, i, err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// isMember reports whether device carries an md superblock for this array.
+// mdadm prefixes the name with the creating host, which may have changed.
+func (f *RaidFinder) isMember(device string) bool {
+	output, err := exec.Command("mdadm", "--examine", "--export", device).Output()
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if name, ok := strings.CutPrefix(line, "MD_NAME="); ok {
+			return name == f.Name || strings.HasSuffix(name, ":"+f.Name)
+		}
+	}
+	return false
+}
+
+// isUnusedDisk reports whether a disk is safe to claim: no partitions, no
+// holders and no recognizable signature.
+func isUnusedDisk(device string) bool {
+	name := filepath.Base(device)
+
+	if holders, err := os.ReadDir(filepath.Join("/sys/class/block", name, "holders")); err != nil || len(holders) > 0 {
+		return false
+	}
+
+	if partitions, err := filepath.Glob(filepath.Join("/sys/class/block", name, name+"*", "partition")); err != nil || len(partitions) > 0 {
+		return false
+	}
+
+	output, err := exec.Command("wipefs", "--noheadings", device).Output()
+	return err == nil && strings.TrimSpace(string(output)) == ""
+}
+
+// mdDevice resolves /dev/md/<name> to the kernel device such as /dev/md127.
+func mdDevice(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
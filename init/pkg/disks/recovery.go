@@ -0,0 +1,181 @@
+package disks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/keys"
+)
+
+// errNeedsRecovery marks a key rejected by a disk that has a recovery key.
+// on_fail does not reformat such a disk; the operators can still open it.
+var errNeedsRecovery = errors.New("the disk has an escrowed recovery key, run 'tdx-init recover disk'")
+
+// addRecoveryKey adds a keyslot for a new random recovery key, unlocked by
+// passphrase, stores the key encrypted to each operator in the recovery
+// token and prints those copies. It returns the recovery key.
+func (dm *Manager) addRecoveryKey(disk *ManagedDisk, passphrase string) (string, error) {
+	recoveryKey, err := keys.NewRecoveryKey()
+	if err != nil {
+		return "", err
+	}
+
+	escrowed, err := keys.EscrowRecoveryKey(disk.Name, recoveryKey, disk.Config.Recovery.OperatorKeys)
+	if err != nil {
+		return "", err
+	}
+	escrowJSON, err := json.Marshal(escrowed)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal recovery key: %w", err)
+	}
+
+	log.Printf("Adding recovery keyslot to %s", disk.DevicePath)
+	if err := dm.ops.LuksAddKey(disk.DevicePath, passphrase, recoveryKey); err != nil {
+		return "", err
+	}
+
+	token := &Token{
+		Type:     "tdx-recovery",
+		Keyslots: []string{},
+		UserData: map[string]string{"escrow": string(escrowJSON)},
+	}
+	if err := dm.ops.ImportToken(disk.DevicePath, RecoveryTokenID, token); err != nil {
+		return "", fmt.Errorf("failed to store recovery token: %w", err)
+	}
+
+	printEscrowedKeys(escrowed)
+	return recoveryKey, nil
+}
+
+// EscrowedRecoveryKeys returns the copies of the disk's recovery key kept
+// in its LUKS header.
+func (dm *Manager) EscrowedRecoveryKeys(name string) ([]keys.EscrowedKey, error) {
+	disk, err := dm.LocateDisk(name)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := dm.ops.ExportToken(disk.DevicePath, RecoveryTokenID)
+	if err != nil {
+		return nil, fmt.Errorf("disk %s has no recovery key", name)
+	}
+
+	var escrowed []keys.EscrowedKey
+	if err := json.Unmarshal([]byte(token.UserData["escrow"]), &escrowed); err != nil {
+		return nil, fmt.Errorf("failed to parse recovery token: %w", err)
+	}
+	return escrowed, nil
+}
+
+func (dm *Manager) hasRecoveryKey(devicePath string) bool {
+	_, err := dm.ops.ExportToken(devicePath, RecoveryTokenID)
+	return err == nil
+}
+
+// Recover opens a disk whose key is lost, e.g. after the TPM was reset,
+// with its recovery key. The disk gets a new key from its provider, which
+// is stored as on format, and a new recovery key, since the old one has
+// left the operators' hands. All other keyslots are removed.
+func (dm *Manager) Recover(ctx context.Context, name, recoveryKey string) error {
+	disk, err := dm.LocateDisk(name)
+	if err != nil {
+		return err
+	}
+
+	keyName := disk.Config.EncryptionKey
+	if keyName == "" {
+		return fmt.Errorf("disk %s is not encrypted", name)
+	}
+	if !dm.ops.IsLuks(disk.DevicePath) {
+		return fmt.Errorf("disk %s has no LUKS container on %s", name, disk.DevicePath)
+	}
+	if !dm.hasRecoveryKey(disk.DevicePath) {
+		return fmt.Errorf("disk %s has no recovery key", name)
+	}
+	if err := dm.checkKeyNotShared(name, keyName); err != nil {
+		return err
+	}
+
+	if _, err := dm.ops.LuksKeyslot(disk.DevicePath, recoveryKey); err != nil {
+		return fmt.Errorf("recovery key rejected: %w", err)
+	}
+
+	newKey, err := dm.keyManager.NextKey(ctx, keyName)
+	if err != nil {
+		return fmt.Errorf("failed to get new key: %w", err)
+	}
+
+	log.Printf("Adding new keyslot to %s", disk.DevicePath)
+	if err := dm.ops.LuksAddKey(disk.DevicePath, recoveryKey, newKey); err != nil {
+		return err
+	}
+	if err := dm.keyManager.StoreKey(keyName, newKey); err != nil {
+		if removeErr := dm.ops.LuksRemoveKey(disk.DevicePath, newKey); removeErr != nil {
+			log.Printf("Warning: Failed to remove new keyslot from %s: %v", disk.DevicePath, removeErr)
+		}
+		return fmt.Errorf("failed to store new key: %w", err)
+	}
+	if err := dm.recordKeyFingerprint(disk.DevicePath, newKey); err != nil {
+		log.Printf("Warning: Failed to record new key in init token: %v", err)
+	}
+
+	keep := []string{newKey}
+	if disk.Config.Recovery == nil {
+		log.Printf("Warning: Disk %s has no recovery config, keeping the used recovery key", name)
+		keep = append(keep, recoveryKey)
+	} else if newRecoveryKey, err := dm.addRecoveryKey(disk, newKey); err != nil {
+		log.Printf("Warning: Failed to replace recovery key, keeping the used one: %v", err)
+		keep = append(keep, recoveryKey)
+	} else {
+		keep = append(keep, newRecoveryKey)
+	}
+
+	if err := dm.killOtherKeyslots(disk, newKey, keep); err != nil {
+		return fmt.Errorf("disk %s recovered but old keyslots remain: %w", name, err)
+	}
+
+	log.Printf("Disk %s recovered", name)
+	return nil
+}
+
+// killOtherKeyslots removes every keyslot not opened by one of keep. The
+// lost key cannot authorize its own removal, so slots are killed by number.
+func (dm *Manager) killOtherKeyslots(disk *ManagedDisk, passphrase string, keep []string) error {
+	kept := make(map[int]bool)
+	for _, key := range keep {
+		slot, err := dm.ops.LuksKeyslot(disk.DevicePath, key)
+		if err != nil {
+			return err
+		}
+		kept[slot] = true
+	}
+
+	slots, err := dm.ops.LuksKeyslots(disk.DevicePath)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if kept[slot] {
+			continue
+		}
+		log.Printf("Removing keyslot %d from %s", slot, disk.DevicePath)
+		if err := dm.ops.LuksKillSlot(disk.DevicePath, slot, passphrase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printEscrowedKeys(escrowed []keys.EscrowedKey) {
+	for _, key := range escrowed {
+		out, err := json.Marshal(key)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "TDX_INIT_RECOVERY %s\n", out)
+	}
+}
@@ -0,0 +1,91 @@
+package disks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Rekey replaces the passphrase of an encrypted disk with a new key from
+// its provider. The steps are ordered so that at every point the disk
+// accepts the key the provider will hand out on the next boot: the new
+// keyslot is added first, then the stored key is switched over, and only
+// then is the old keyslot removed.
+func (dm *Manager) Rekey(ctx context.Context, name string) error {
+	disk, err := dm.LocateDisk(name)
+	if err != nil {
+		return err
+	}
+
+	if disk.Config.Format == "ephemeral" {
+		return fmt.Errorf("disk %s is ephemeral, its key is never kept", name)
+	}
+
+	keyName := disk.Config.EncryptionKey
+	if keyName == "" {
+		return fmt.Errorf("disk %s is not encrypted", name)
+	}
+	if !dm.ops.IsLuks(disk.DevicePath) {
+		return fmt.Errorf("disk %s has no LUKS container on %s", name, disk.DevicePath)
+	}
+
+	if err := dm.checkKeyNotShared(name, keyName); err != nil {
+		return err
+	}
+
+	oldKey, err := dm.keyManager.GetKey(ctx, keyName)
+	if err != nil {
+		return fmt.Errorf("failed to get current key: %w", err)
+	}
+
+	newKey, err := dm.keyManager.NextKey(ctx, keyName)
+	if err != nil {
+		return fmt.Errorf("failed to get new key: %w", err)
+	}
+	if newKey == oldKey {
+		return fmt.Errorf("key %s provided the current key again", keyName)
+	}
+
+	log.Printf("Adding new keyslot to %s", disk.DevicePath)
+	if err := dm.ops.LuksAddKey(disk.DevicePath, oldKey, newKey); err != nil {
+		return err
+	}
+
+	if err := dm.keyManager.StoreKey(keyName, newKey); err != nil {
+		// Back out so the disk is left with only the key still stored
+		if removeErr := dm.ops.LuksRemoveKey(disk.DevicePath, newKey); removeErr != nil {
+			log.Printf("Warning: Failed to remove new keyslot from %s: %v", disk.DevicePath, removeErr)
+		}
+		return fmt.Errorf("failed to store new key: %w", err)
+	}
+	if err := dm.recordKeyFingerprint(disk.DevicePath, newKey); err != nil {
+		log.Printf("Warning: Failed to record new key in init token: %v", err)
+	}
+
+	log.Printf("Removing old keyslot from %s", disk.DevicePath)
+	if err := dm.ops.LuksRemoveKey(disk.DevicePath, oldKey); err != nil {
+		return fmt.Errorf("new key is in use but the old keyslot remains: %w", err)
+	}
+
+	log.Printf("Disk %s re-keyed", name)
+	return nil
+}
+
+// checkKeyNotShared refuses a key that other disks use too. The key is
+// stored once per key name, so replacing it for one disk would lock the
+// others out.
+func (dm *Manager) checkKeyNotShared(name, keyName string) error {
+	var shared []string
+	for other, otherDisk := range dm.disks {
+		if other != name && otherDisk.Config.EncryptionKey == keyName {
+			shared = append(shared, other)
+		}
+	}
+	if len(shared) > 0 {
+		sort.Strings(shared)
+		return fmt.Errorf("key %s is also used by disk(s) %s", keyName, strings.Join(shared, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package disks
+
+import (
+	"fmt"
+	"log"
+)
+
+// growLuks extends an open LUKS mapping to the end of its backing device if
+// the device has grown. Mappings with dm-integrity are left alone: their
+// tags take up part of the device, so its size does not show whether it
+// has grown.
+func (dm *Manager) growLuks(disk *ManagedDisk, passphrase string) (bool, error) {
+	params, err := dm.ops.LuksParams(disk.DevicePath)
+	if err != nil {
+		return false, err
+	}
+	if params.Integrity != "" {
+		return false, nil
+	}
+
+	status, err := dm.ops.LuksStatus(disk.MapperName)
+	if err != nil {
+		return false, err
+	}
+
+	deviceSize, err := dm.ops.DeviceSize(disk.DevicePath)
+	if err != nil {
+		return false, err
+	}
+
+	if deviceSize <= status.Offset+status.Size {
+		return false, nil
+	}
+
+	log.Printf("Growing LUKS mapping %s from %d to %d bytes", disk.MapperName, status.Size, deviceSize-status.Offset)
+	if err := dm.ops.LuksResize(disk.MapperName, passphrase); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// resizeFilesystem grows the filesystem mounted from device to fill it.
+// ext4 and xfs can both grow while mounted.
+func (dm *Manager) resizeFilesystem(disk *ManagedDisk, device, fsType string) (bool, error) {
+	if fsType != "ext4" && fsType != "xfs" {
+		return false, fmt.Errorf("growing %s filesystems is not supported", fsType)
+	}
+
+	fsSize, blockSize, err := dm.ops.FilesystemSize(device, disk.Config.MountAt, fsType)
+	if err != nil {
+		return false, err
+	}
+
+	deviceSize, err := dm.ops.DeviceSize(device)
+	if err != nil {
+		return false, err
+	}
+
+	// Less than one block of slack cannot be used.
+	if deviceSize-fsSize < blockSize {
+		return false, nil
+	}
+
+	log.Printf("Growing %s filesystem on %s from %d to %d bytes", fsType, device, fsSize, deviceSize)
+	if err := dm.ops.GrowFilesystem(device, disk.Config.MountAt, fsType); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,51 @@
+package disks
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+)
+
+// mayWipeForeign reports whether cfg allows formatting over data tdx-init
+// did not write. format: always already asks for a wipe on every boot.
+func mayWipeForeign(cfg config.DiskConfig) bool {
+	return cfg.AllowWipeForeign || cfg.Format == "always"
+}
+
+// checkWipe refuses to format a disk unless it is blank, holds a LUKS
+// container tdx-init initialized or partly formatted for this same disk
+// entry, or the config allows wiping foreign data. For an ephemeral disk only
+// blank or unrecognised data, such as its own earlier plain dm-crypt, passes. The error lists what was
+// found.
+func (dm *Manager) checkWipe(disk *ManagedDisk) error {
+	if mayWipeForeign(disk.Config) {
+		return nil
+	}
+
+	// An ephemeral disk never writes a LUKS header, so any header, even an
+	// init token, belongs to another disk.
+	ephemeral := disk.Config.Format == "ephemeral"
+	if !ephemeral && dm.ops.IsLuks(disk.DevicePath) {
+		if data, err := dm.initToken(disk.DevicePath); err == nil && data["disk_name"] == disk.Name {
+			return nil
+		}
+		if dm.formatPhase(disk) != "" {
+			return nil
+		}
+	}
+
+	signatures, err := dm.ops.Signatures(disk.DevicePath)
+	if err != nil {
+		return fmt.Errorf("refusing to format %s, cannot tell whether it is blank: %w", disk.DevicePath, err)
+	}
+	if len(signatures) > 0 && ephemeral {
+		return fmt.Errorf("refusing to use %s as an ephemeral disk, it holds data (%s); set allow_wipe_foreign to format it anyway",
+			disk.DevicePath, strings.Join(signatures, ", "))
+	}
+	if len(signatures) > 0 {
+		return fmt.Errorf("refusing to format %s, it holds data not written by tdx-init (%s); set allow_wipe_foreign to format it anyway",
+			disk.DevicePath, strings.Join(signatures, ", "))
+	}
+	return nil
+}
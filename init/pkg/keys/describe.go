@@ -0,0 +1,66 @@
+package keys
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+)
+
+// DescribeSource says where a key configured as cfg comes from, e.g. for
+// a dry run. It does not touch the TPM or the network.
+func DescribeSource(cfg config.KeyConfig) string {
+	var source string
+	switch cfg.Strategy {
+	case "random":
+		source = "generated at random"
+		if !cfg.TPM {
+			source += " (not kept, so an existing disk cannot be reopened)"
+		}
+
+	case "pipe":
+		pipePath := "/tmp/passphrase"
+		if path, ok := cfg.StrategyConfig["pipe_path"].(string); ok {
+			pipePath = path
+		}
+		source = fmt.Sprintf("waits for the passphrase on pipe %s", pipePath)
+
+	case "https":
+		listenAddr := "0.0.0.0:8443"
+		if addr, ok := cfg.StrategyConfig["listen_addr"].(string); ok {
+			listenAddr = addr
+		}
+		signers, _ := cfg.StrategyConfig["trusted_signers"].([]interface{})
+		source = fmt.Sprintf("waits for the key over attested HTTPS on %s, signed by one of %d trusted signers", listenAddr, len(signers))
+
+	case "kbs":
+		url, _ := cfg.StrategyConfig["url"].(string)
+		source = fmt.Sprintf("requests the key from key broker %s", url)
+
+	case "shamir":
+		threshold, _ := cfg.StrategyConfig["threshold"].(int)
+		var inputs []string
+		if pipes, ok := cfg.StrategyConfig["share_pipes"].([]interface{}); ok {
+			for _, pipe := range pipes {
+				inputs = append(inputs, fmt.Sprintf("pipe %v", pipe))
+			}
+		}
+		if server, ok := cfg.StrategyConfig["share_server"].(string); ok && server != "" {
+			inputs = append(inputs, "https://"+server+"/share")
+		}
+		source = fmt.Sprintf("waits for %d shares on %s", threshold, strings.Join(inputs, ", "))
+
+	default:
+		return fmt.Sprintf("unknown key strategy %s", cfg.Strategy)
+	}
+
+	if !cfg.TPM {
+		return source
+	}
+
+	tpmSource := fmt.Sprintf("TPM NV index %s", cfg.NVIndex)
+	if cfg.TPMPolicy != nil {
+		tpmSource += fmt.Sprintf(" sealed to PCRs %v", cfg.TPMPolicy.PCRs)
+	}
+	return fmt.Sprintf("%s if stored there, otherwise %s", tpmSource, source)
+}
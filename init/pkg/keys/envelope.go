@@ -0,0 +1,95 @@
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// Envelope is plaintext encrypted to an X25519 public key: a fresh sender
+// key pair, HKDF-SHA256 over the shared secret and AES-256-GCM with the
+// recipient public key as additional data.
+type Envelope struct {
+	PublicKey  string `json:"public_key"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+func sealEnvelope(recipient *ecdh.PublicKey, plaintext []byte, info string) (Envelope, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("failed to generate sender key: %w", err)
+	}
+
+	aead, err := deriveAEAD(private, recipient, info)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return Envelope{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return Envelope{
+		PublicKey:  base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()),
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, recipient.Bytes())),
+	}, nil
+}
+
+func openEnvelope(private *ecdh.PrivateKey, env Envelope, info string) ([]byte, error) {
+	senderBytes, err := base64.StdEncoding.DecodeString(env.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender public key encoding: %w", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce encoding: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext encoding: %w", err)
+	}
+
+	sender, err := ecdh.X25519().NewPublicKey(senderBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender public key: %w", err)
+	}
+
+	aead, err := deriveAEAD(private, sender, info)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size %d", len(nonce))
+	}
+
+	return aead.Open(nil, nonce, ciphertext, private.PublicKey().Bytes())
+}
+
+// deriveAEAD derives an AES-256-GCM cipher from an X25519 exchange. info
+// separates the uses of the scheme so keys never cross protocols.
+func deriveAEAD(private *ecdh.PrivateKey, peer *ecdh.PublicKey, info string) (cipher.AEAD, error) {
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+
+	wrapKey, err := hkdf.Key(sha256.New, shared, nil, info, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive wrapping key: %w", err)
+	}
+
+	block, err := aes.NewCipher(wrapKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
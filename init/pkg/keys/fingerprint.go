@@ -0,0 +1,44 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const fingerprintPrefix = "argon2id"
+
+// Fingerprint identifies key without making a weak passphrase easier to
+// guess than the LUKS keyslot it opens: it is a salted Argon2id hash,
+// "argon2id:<salt>:<hash>".
+func Fingerprint(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return formatFingerprint(salt, key), nil
+}
+
+// MatchesFingerprint reports whether key is the one fingerprint was made
+// from.
+func MatchesFingerprint(key, fingerprint string) bool {
+	parts := strings.Split(fingerprint, ":")
+	if len(parts) != 3 || parts[0] != fingerprintPrefix {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(formatFingerprint(salt, key)), []byte(fingerprint)) == 1
+}
+
+func formatFingerprint(salt []byte, key string) string {
+	hash := argon2.IDKey([]byte(key), salt, 3, 64*1024, 4, 16)
+	return fmt.Sprintf("%s:%s:%s", fingerprintPrefix,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
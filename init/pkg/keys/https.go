@@ -0,0 +1,174 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/attestation"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/signing"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
+)
+
+// HTTPSProvider receives the passphrase over HTTPS. The TLS certificate is
+// generated inside the TD and its public key is bound into a quote served on
+// GET /attestation, so operators can verify the VM before POSTing to /key.
+// The TLS identity only proves the VM to the operator; the passphrase must be
+// signed by one of TrustedSigners over a nonce from GET /nonce, as for SSH
+// key submissions, or anyone reaching the port first could set the key.
+type HTTPSProvider struct {
+	ListenAddr     string
+	UseTPM         bool
+	Quoter         attestation.QuoteProvider
+	TrustedSigners []gossh.PublicKey
+	tpmStorage     *tpm.TPMStorage
+	cachedKey      string
+	nonces         signing.NonceStore
+}
+
+func NewHTTPSProvider(listenAddr string, quoter attestation.QuoteProvider, trustedSigners []gossh.PublicKey, tpmStorage *tpm.TPMStorage) *HTTPSProvider {
+	return &HTTPSProvider{
+		ListenAddr:     listenAddr,
+		UseTPM:         tpmStorage != nil,
+		Quoter:         quoter,
+		TrustedSigners: trustedSigners,
+		tpmStorage:     tpmStorage,
+	}
+}
+
+func (h *HTTPSProvider) Get(ctx context.Context) (string, error) {
+	if h.UseTPM && h.tpmStorage.Available() {
+		key, err := h.tpmStorage.Retrieve()
+		if err == nil && key != "" {
+			log.Println("Retrieved existing key from TPM")
+			h.cachedKey = key
+			return key, nil
+		}
+		if err != nil && !errors.Is(err, tpm.ErrIndexNotDefined) {
+			return "", fmt.Errorf("failed to retrieve key from TPM: %w", err)
+		}
+	}
+
+	if h.cachedKey != "" {
+		return h.cachedKey, nil
+	}
+
+	key, err := h.waitForKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	h.cachedKey = key
+	if h.UseTPM && h.tpmStorage.Available() {
+		if err := h.tpmStorage.Store(key); err != nil {
+			log.Printf("Warning: Failed to store key in TPM: %v", err)
+		}
+	}
+
+	return key, nil
+}
+
+func (h *HTTPSProvider) Store(key string) error {
+	h.cachedKey = key
+	if h.UseTPM && h.tpmStorage.Available() {
+		return h.tpmStorage.Store(key)
+	}
+	return nil
+}
+
+// NextKey waits for the replacement key to be POSTed, as on first boot.
+func (h *HTTPSProvider) NextKey(ctx context.Context) (string, error) {
+	return h.waitForKey(ctx)
+}
+
+func (h *HTTPSProvider) waitForKey(ctx context.Context) (string, error) {
+	attested, err := attestation.NewAttestedTLS(h.Quoter, "tdx-init")
+	if err != nil {
+		return "", err
+	}
+
+	keyReceivedChan := make(chan string, 1)
+	serverErrChan := make(chan error, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/attestation", attested.ServeEvidence)
+	mux.HandleFunc("/nonce", h.nonces.ServeNonce)
+	mux.Handle("/key", h.keyHandler(keyReceivedChan))
+
+	server := &http.Server{
+		Addr:              h.ListenAddr,
+		Handler:           mux,
+		TLSConfig:         attested.TLSConfig(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	log.Printf("Waiting for key on https://%s/key (TLS public key sha256 %s)", h.ListenAddr, attested.SPKIFingerprint())
+
+	go func() {
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			serverErrChan <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		server.Shutdown(context.Background())
+		return "", ctx.Err()
+	case err := <-serverErrChan:
+		return "", fmt.Errorf("key server error: %w", err)
+	case key := <-keyReceivedChan:
+		server.Shutdown(context.Background())
+		return key, nil
+	}
+}
+
+// keyHandler accepts the first signed key POSTed to /key.
+func (h *HTTPSProvider) keyHandler(keyReceivedChan chan<- string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprint(w, "Only POST method is allowed")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 8192))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error reading request: %v", err)
+			return
+		}
+
+		key, err := signing.VerifySubmission(body, h.TrustedSigners, &h.nonces)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+
+		key = strings.TrimSpace(key)
+		if key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Empty key")
+			return
+		}
+
+		select {
+		case keyReceivedChan <- key:
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "Key received")
+		default:
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, "Key already received")
+		}
+	})
+}
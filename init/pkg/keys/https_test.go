@@ -0,0 +1,107 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/signing"
+)
+
+func newOperator(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sshsign produces what `ssh-keygen -Y sign -n tdx-init` would.
+func sshsign(t *testing.T, signer gossh.Signer, message []byte) string {
+	t.Helper()
+	digest := sha512.Sum512(message)
+	signed := append([]byte("SSHSIG"), gossh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{signing.SignatureNamespace, "", "sha512", digest[:]})...)
+
+	signature, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte("SSHSIG"), gossh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{1, signer.PublicKey().Marshal(), signing.SignatureNamespace, "", "sha512", gossh.Marshal(signature)})...)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob}))
+}
+
+func TestHTTPSProviderRequiresSignedKey(t *testing.T) {
+	operator := newOperator(t)
+	stranger := newOperator(t)
+	provider := NewHTTPSProvider("", fakeQuoter{}, []gossh.PublicKey{operator.PublicKey()}, nil)
+	keys := make(chan string, 1)
+	handler := provider.keyHandler(keys)
+
+	nonce := func() string {
+		recorder := httptest.NewRecorder()
+		provider.nonces.ServeNonce(recorder, httptest.NewRequest(http.MethodGet, "/nonce", nil))
+		return recorder.Body.String()
+	}
+	submit := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/key", strings.NewReader(body)))
+		return recorder
+	}
+	submission := func(signer gossh.Signer, nonce, key string) string {
+		body, err := json.Marshal(signing.SignedKeySubmission{
+			Key:       key,
+			Nonce:     nonce,
+			Signature: sshsign(t, signer, signing.SignedMessage(nonce, key)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	if resp := submit("attacker-key"); resp.Code != http.StatusBadRequest {
+		t.Fatalf("unsigned key: status %d, want %d", resp.Code, http.StatusBadRequest)
+	}
+	if resp := submit(submission(stranger, nonce(), "attacker-key")); resp.Code != http.StatusBadRequest {
+		t.Fatalf("untrusted signer: status %d, want %d", resp.Code, http.StatusBadRequest)
+	}
+	if resp := submit(submission(operator, "made-up", "disk-key")); resp.Code != http.StatusBadRequest {
+		t.Fatalf("unknown nonce: status %d, want %d", resp.Code, http.StatusBadRequest)
+	}
+
+	signed := submission(operator, nonce(), "disk-key")
+	if resp := submit(signed); resp.Code != http.StatusOK {
+		t.Fatalf("signed key: status %d (%s), want %d", resp.Code, resp.Body, http.StatusOK)
+	}
+	if key := <-keys; key != "disk-key" {
+		t.Fatalf("received key %q, want %q", key, "disk-key")
+	}
+	if resp := submit(signed); resp.Code != http.StatusBadRequest {
+		t.Fatalf("replayed nonce: status %d, want %d", resp.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,241 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/attestation"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
+)
+
+// kbsKeyInfo is the HKDF info string both sides use to derive the AES-GCM
+// key that wraps the released disk key.
+const kbsKeyInfo = "tdx-init kbs key release v1"
+
+// errKBSRefused marks failures that asking again cannot fix, such as the
+// broker rejecting the quote or a release that does not decrypt.
+var errKBSRefused = errors.New("key broker request cannot succeed")
+
+type KBSRequest struct {
+	KeyID        string `json:"key_id,omitempty"`
+	EvidenceType string `json:"evidence_type"`
+	Quote        string `json:"quote"`
+	PublicKey    string `json:"public_key"`
+}
+
+type KBSResponse = Envelope
+
+// KBSProvider obtains the disk key from a remote key broker. It sends a TDX
+// quote whose report data is the hash of a fresh X25519 public key; the
+// broker verifies the quote and answers with the key sealed to that public
+// key using ECDH, HKDF-SHA256 and AES-256-GCM.
+type KBSProvider struct {
+	URL           string
+	KeyID         string
+	RetryInterval time.Duration
+	UseTPM        bool
+	Quoter        attestation.QuoteProvider
+	Client        *http.Client
+	tpmStorage    *tpm.TPMStorage
+	cachedKey     string
+}
+
+func NewKBSProvider(url, keyID string, quoter attestation.QuoteProvider, client *http.Client, tpmStorage *tpm.TPMStorage) *KBSProvider {
+	return &KBSProvider{
+		URL:           url,
+		KeyID:         keyID,
+		RetryInterval: 5 * time.Second,
+		UseTPM:        tpmStorage != nil,
+		Quoter:        quoter,
+		Client:        client,
+		tpmStorage:    tpmStorage,
+	}
+}
+
+func (k *KBSProvider) Get(ctx context.Context) (string, error) {
+	if k.UseTPM && k.tpmStorage.Available() {
+		key, err := k.tpmStorage.Retrieve()
+		if err == nil && key != "" {
+			log.Println("Retrieved existing key from TPM")
+			k.cachedKey = key
+			return key, nil
+		}
+		if err != nil && !errors.Is(err, tpm.ErrIndexNotDefined) {
+			return "", fmt.Errorf("failed to retrieve key from TPM: %w", err)
+		}
+	}
+
+	if k.cachedKey != "" {
+		return k.cachedKey, nil
+	}
+
+	key, err := k.fetchKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	k.cachedKey = key
+	if k.UseTPM && k.tpmStorage.Available() {
+		if err := k.tpmStorage.Store(key); err != nil {
+			log.Printf("Warning: Failed to store key in TPM: %v", err)
+		}
+	}
+	return key, nil
+}
+
+// NextKey asks the broker again, for when it has rotated the key.
+func (k *KBSProvider) NextKey(ctx context.Context) (string, error) {
+	return k.fetchKey(ctx)
+}
+
+// fetchKey requests the key until the broker releases it. Only transport
+// errors and server errors are retried; a refusal ends the attempt.
+func (k *KBSProvider) fetchKey(ctx context.Context) (string, error) {
+	log.Printf("Requesting key from key broker %s", k.URL)
+
+	for {
+		key, err := k.requestKey(ctx)
+		if err == nil {
+			return key, nil
+		}
+		if errors.Is(err, errKBSRefused) {
+			return "", err
+		}
+
+		log.Printf("Key broker request failed, retrying in %s: %v", k.RetryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(k.RetryInterval):
+		}
+	}
+}
+
+func (k *KBSProvider) Store(key string) error {
+	k.cachedKey = key
+	if k.UseTPM && k.tpmStorage.Available() {
+		return k.tpmStorage.Store(key)
+	}
+	return nil
+}
+
+func (k *KBSProvider) requestKey(ctx context.Context) (string, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to generate ephemeral key: %v", errKBSRefused, err)
+	}
+	public := private.PublicKey().Bytes()
+
+	quote, err := k.Quoter.Quote(attestation.ReportDataFor(public))
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to generate quote: %v", errKBSRefused, err)
+	}
+
+	body, err := json.Marshal(KBSRequest{
+		KeyID:        k.KeyID,
+		EvidenceType: k.Quoter.EvidenceType(),
+		Quote:        base64.StdEncoding.EncodeToString(quote),
+		PublicKey:    base64.StdEncoding.EncodeToString(public),
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to marshal key request: %v", errKBSRefused, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to create key request: %v", errKBSRefused, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to contact key broker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read key broker response: %w", err)
+	}
+
+	if resp.StatusCode >= 500 {
+		return "", fmt.Errorf("key broker returned %s: %s", resp.Status, string(respBody))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: key broker returned %s: %s", errKBSRefused, resp.Status, string(respBody))
+	}
+
+	var release KBSResponse
+	if err := json.Unmarshal(respBody, &release); err != nil {
+		return "", fmt.Errorf("%w: failed to parse key broker response: %v", errKBSRefused, err)
+	}
+
+	key, err := OpenKBSResponse(private, release)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errKBSRefused, err)
+	}
+
+	log.Println("Received key from key broker")
+	return key, nil
+}
+
+// OpenKBSResponse decrypts a wrapped key released by the broker to the
+// holder of private.
+func OpenKBSResponse(private *ecdh.PrivateKey, release KBSResponse) (string, error) {
+	plaintext, err := openEnvelope(private, release, kbsKeyInfo)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt released key: %w", err)
+	}
+
+	if len(plaintext) == 0 {
+		return "", fmt.Errorf("key broker released an empty key")
+	}
+
+	return string(plaintext), nil
+}
+
+// newKBSClient returns the client for a broker at url, which must use https
+// unless allowHTTP is set, e.g. for a broker on a test network.
+func newKBSClient(url, caCertPath string, allowHTTP bool, timeout time.Duration) (*http.Client, error) {
+	if !strings.HasPrefix(url, "https://") && !allowHTTP {
+		return nil, fmt.Errorf("key broker url %s must use https", url)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	if caCertPath == "" {
+		return client, nil
+	}
+
+	pem, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key broker CA certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caCertPath)
+	}
+
+	client.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	return client, nil
+}
@@ -0,0 +1,218 @@
+package keys
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/attestation"
+)
+
+// fakeQuoter returns the report data itself as the quote, so the broker can
+// check what the TD bound into it.
+type fakeQuoter struct{}
+
+func (fakeQuoter) Quote(reportData [attestation.ReportDataSize]byte) ([]byte, error) {
+	return reportData[:], nil
+}
+
+func (fakeQuoter) EvidenceType() string {
+	return attestation.EvidenceTypeQuote
+}
+
+// sealKBSResponse is the broker side of OpenKBSResponse.
+func sealKBSResponse(recipient *ecdh.PublicKey, key string) (KBSResponse, error) {
+	return sealEnvelope(recipient, []byte(key), kbsKeyInfo)
+}
+
+// newBroker starts a stand-in key broker that checks the request and lets
+// release answer it.
+func newBroker(t *testing.T, release func(w http.ResponseWriter, recipient *ecdh.PublicKey)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req KBSRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.KeyID != "disk-key" || req.EvidenceType != attestation.EvidenceTypeQuote {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		public, err := base64.StdEncoding.DecodeString(req.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		quote, err := base64.StdEncoding.DecodeString(req.Quote)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reportData := attestation.ReportDataFor(public)
+		if string(quote) != string(reportData[:]) {
+			http.Error(w, "quote does not bind the public key", http.StatusForbidden)
+			return
+		}
+
+		recipient, err := ecdh.X25519().NewPublicKey(public)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		release(w, recipient)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func writeRelease(t *testing.T, w http.ResponseWriter, release KBSResponse) {
+	t.Helper()
+	if err := json.NewEncoder(w).Encode(release); err != nil {
+		t.Errorf("failed to write release: %v", err)
+	}
+}
+
+func TestKBSProviderReleasesKey(t *testing.T) {
+	broker := newBroker(t, func(w http.ResponseWriter, recipient *ecdh.PublicKey) {
+		release, err := sealKBSResponse(recipient, "secret")
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeRelease(t, w, release)
+	})
+
+	provider := NewKBSProvider(broker.URL, "disk-key", fakeQuoter{}, broker.Client(), nil)
+	key, err := provider.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if key != "secret" {
+		t.Fatalf("Get = %q, want %q", key, "secret")
+	}
+}
+
+func TestKBSProviderRejectsBadReleases(t *testing.T) {
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		release func(t *testing.T, w http.ResponseWriter, recipient *ecdh.PublicKey)
+		wantErr string
+	}{
+		{
+			name: "wrong recipient",
+			release: func(t *testing.T, w http.ResponseWriter, _ *ecdh.PublicKey) {
+				release, err := sealKBSResponse(other.PublicKey(), "secret")
+				if err != nil {
+					t.Error(err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				writeRelease(t, w, release)
+			},
+			wantErr: "failed to decrypt released key",
+		},
+		{
+			name: "error status",
+			release: func(t *testing.T, w http.ResponseWriter, _ *ecdh.PublicKey) {
+				http.Error(w, "measurement not allowed", http.StatusForbidden)
+			},
+			wantErr: "403 Forbidden: measurement not allowed",
+		},
+		{
+			name: "tampered ciphertext",
+			release: func(t *testing.T, w http.ResponseWriter, recipient *ecdh.PublicKey) {
+				release, err := sealKBSResponse(recipient, "secret")
+				if err != nil {
+					t.Error(err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				ciphertext, err := base64.StdEncoding.DecodeString(release.Ciphertext)
+				if err != nil {
+					t.Error(err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				ciphertext[0] ^= 1
+				release.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext)
+				writeRelease(t, w, release)
+			},
+			wantErr: "failed to decrypt released key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newBroker(t, func(w http.ResponseWriter, recipient *ecdh.PublicKey) {
+				tt.release(t, w, recipient)
+			})
+
+			// A refusal must end Get rather than be retried until the timeout
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			provider := NewKBSProvider(broker.URL, "disk-key", fakeQuoter{}, broker.Client(), nil)
+			key, err := provider.Get(ctx)
+			if err == nil {
+				t.Fatalf("Get = %q, want error", key)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Get error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKBSProviderRetriesServerErrors(t *testing.T) {
+	var attempts atomic.Int32
+	broker := newBroker(t, func(w http.ResponseWriter, recipient *ecdh.PublicKey) {
+		if attempts.Add(1) < 3 {
+			http.Error(w, "broker starting", http.StatusServiceUnavailable)
+			return
+		}
+		release, err := sealKBSResponse(recipient, "secret")
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeRelease(t, w, release)
+	})
+
+	provider := NewKBSProvider(broker.URL, "disk-key", fakeQuoter{}, broker.Client(), nil)
+	provider.RetryInterval = time.Millisecond
+	key, err := provider.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if key != "secret" || attempts.Load() != 3 {
+		t.Fatalf("Get = %q after %d attempts, want %q after 3", key, attempts.Load(), "secret")
+	}
+}
+
+func TestNewKBSClientRequiresHTTPS(t *testing.T) {
+	if _, err := newKBSClient("http://kbs.example.com/v1/release", "", false, time.Second); err == nil {
+		t.Fatal("newKBSClient accepted an http url")
+	}
+	if _, err := newKBSClient("http://kbs.example.com/v1/release", "", true, time.Second); err != nil {
+		t.Fatalf("newKBSClient with allowHTTP: %v", err)
+	}
+	if _, err := newKBSClient("https://kbs.example.com/v1/release", "", false, time.Second); err != nil {
+		t.Fatalf("newKBSClient: %v", err)
+	}
+}
@@ -3,8 +3,12 @@ package keys
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/attestation"
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/signing"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
 )
 
 type Manager struct {
@@ -16,31 +20,42 @@ type Provider interface {
 	Store(key string) error
 }
 
+// Generator is implemented by providers whose keys cannot be generated
+// lazily by Get, because creating a key has side effects such as handing
+// out shares.
+type Generator interface {
+	Generate(ctx context.Context) (string, error)
+}
+
+// Rotator is implemented by providers that can obtain a replacement key
+// without storing it, so a disk can be re-keyed before the stored copy is
+// switched over.
+type Rotator interface {
+	NextKey(ctx context.Context) (string, error)
+}
+
 func NewManager(cfg *config.Config) (*Manager, error) {
 	m := &Manager{
 		keys: make(map[string]Provider),
 	}
 
-	hasTPM := false
-
 	for name, keyCfg := range cfg.Keys {
 		provider, err := CreateProvider(keyCfg)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create key provider for %s: %w", name, err)
 		}
 		m.keys[name] = provider
-
-		if keyCfg.TPM {
-			if hasTPM {
-				return nil, fmt.Errorf("only one key with TPM enabled is supported")
-			}
-			hasTPM = true
-		}
 	}
 
 	return m, nil
 }
 
+// NewManagerWithProviders creates a Manager serving the given providers by
+// key name, e.g. stand-ins for tests.
+func NewManagerWithProviders(providers map[string]Provider) *Manager {
+	return &Manager{keys: providers}
+}
+
 func (m *Manager) GetKey(ctx context.Context, name string) (string, error) {
 	provider, ok := m.keys[name]
 	if !ok {
@@ -49,6 +64,33 @@ func (m *Manager) GetKey(ctx context.Context, name string) (string, error) {
 	return provider.Get(ctx)
 }
 
+// NewKey returns the key to format a disk with. Providers implementing
+// Generator create a fresh key; all others behave as in GetKey.
+func (m *Manager) NewKey(ctx context.Context, name string) (string, error) {
+	provider, ok := m.keys[name]
+	if !ok {
+		return "", fmt.Errorf("key %s not found", name)
+	}
+	if generator, ok := provider.(Generator); ok {
+		return generator.Generate(ctx)
+	}
+	return provider.Get(ctx)
+}
+
+// NextKey returns a new key for re-keying without storing it anywhere;
+// StoreKey it once the disk accepts it.
+func (m *Manager) NextKey(ctx context.Context, name string) (string, error) {
+	provider, ok := m.keys[name]
+	if !ok {
+		return "", fmt.Errorf("key %s not found", name)
+	}
+	rotator, ok := provider.(Rotator)
+	if !ok {
+		return "", fmt.Errorf("key %s cannot be rotated", name)
+	}
+	return rotator.NextKey(ctx)
+}
+
 func (m *Manager) StoreKey(name string, key string) error {
 	provider, ok := m.keys[name]
 	if !ok {
@@ -58,22 +100,129 @@ func (m *Manager) StoreKey(name string, key string) error {
 }
 
 func CreateProvider(cfg config.KeyConfig) (Provider, error) {
+	tpmStorage, err := newTPMStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	switch cfg.Strategy {
 	case "random":
 		size := 64
 		if s, ok := cfg.StrategyConfig["size"].(int); ok {
 			size = s
 		}
-		return NewRandomProvider(size, cfg.TPM), nil
+		return NewRandomProvider(size, tpmStorage), nil
 
 	case "pipe":
 		pipePath := "/tmp/passphrase"
 		if path, ok := cfg.StrategyConfig["pipe_path"].(string); ok {
 			pipePath = path
 		}
-		return NewPipeProvider(pipePath, cfg.TPM), nil
+		return NewPipeProvider(pipePath, tpmStorage), nil
+
+	case "kbs":
+		url, _ := cfg.StrategyConfig["url"].(string)
+		if url == "" {
+			return nil, fmt.Errorf("kbs strategy requires strategy_config.url")
+		}
+		keyID, _ := cfg.StrategyConfig["key_id"].(string)
+		caCert, _ := cfg.StrategyConfig["ca_cert"].(string)
+		allowHTTP, _ := cfg.StrategyConfig["allow_insecure_http"].(bool)
+
+		client, err := newKBSClient(url, caCert, allowHTTP, 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		quoter, err := attestation.NewQuoteProvider()
+		if err != nil {
+			return nil, err
+		}
+
+		provider := NewKBSProvider(url, keyID, quoter, client, tpmStorage)
+		if s, ok := cfg.StrategyConfig["retry_interval"].(int); ok && s > 0 {
+			provider.RetryInterval = time.Duration(s) * time.Second
+		}
+		return provider, nil
+
+	case "https":
+		listenAddr := "0.0.0.0:8443"
+		if addr, ok := cfg.StrategyConfig["listen_addr"].(string); ok {
+			listenAddr = addr
+		}
+		signerValues, _ := cfg.StrategyConfig["trusted_signers"].([]interface{})
+		signers, err := signing.ParseTrustedSigners(signerValues)
+		if err != nil {
+			return nil, err
+		}
+		if len(signers) == 0 {
+			return nil, fmt.Errorf("https strategy requires strategy_config.trusted_signers")
+		}
+		quoter, err := attestation.NewQuoteProvider()
+		if err != nil {
+			return nil, err
+		}
+		return NewHTTPSProvider(listenAddr, quoter, signers, tpmStorage), nil
+
+	case "shamir":
+		threshold, _ := cfg.StrategyConfig["threshold"].(int)
+		operatorValues, _ := cfg.StrategyConfig["operator_keys"].([]interface{})
+		operatorKeys, err := parseOperatorKeys(operatorValues)
+		if err != nil {
+			return nil, err
+		}
+
+		var sharePipes []string
+		if pipes, ok := cfg.StrategyConfig["share_pipes"].([]interface{}); ok {
+			for _, pipe := range pipes {
+				if path, ok := pipe.(string); ok {
+					sharePipes = append(sharePipes, path)
+				}
+			}
+		}
+		shareServer, _ := cfg.StrategyConfig["share_server"].(string)
+
+		var quoter attestation.QuoteProvider
+		if shareServer != "" {
+			if quoter, err = attestation.NewQuoteProvider(); err != nil {
+				return nil, err
+			}
+		}
+		return NewShamirProvider(threshold, operatorKeys, sharePipes, shareServer, quoter, tpmStorage), nil
 
 	default:
 		return nil, fmt.Errorf("unknown key strategy: %s", cfg.Strategy)
 	}
 }
+
+func newTPMStorage(cfg config.KeyConfig) (*tpm.TPMStorage, error) {
+	if !cfg.TPM {
+		return nil, nil
+	}
+
+	nvIndex := tpm.DefaultNVIndex
+	if cfg.NVIndex != "" {
+		index, err := config.ParseNVIndex(cfg.NVIndex)
+		if err != nil {
+			return nil, err
+		}
+		nvIndex = index
+	}
+
+	storage := tpm.NewTPMStorage(nvIndex)
+	if cfg.TPMPolicy != nil {
+		pcrs := make([]uint, len(cfg.TPMPolicy.PCRs))
+		for i, pcr := range cfg.TPMPolicy.PCRs {
+			pcrs[i] = uint(pcr)
+		}
+		storage = tpm.NewSealedTPMStorage(nvIndex, pcrs)
+	}
+
+	if cfg.LegacyNVIndex != "" {
+		index, err := config.ParseNVIndex(cfg.LegacyNVIndex)
+		if err != nil {
+			return nil, err
+		}
+		storage.LegacyNVIndex = index
+	}
+	return storage, nil
+}
@@ -2,9 +2,11 @@ package keys
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"syscall"
 
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
@@ -17,11 +19,11 @@ type PipeProvider struct {
 	cachedKey  string
 }
 
-func NewPipeProvider(pipePath string, useTPM bool) *PipeProvider {
+func NewPipeProvider(pipePath string, tpmStorage *tpm.TPMStorage) *PipeProvider {
 	return &PipeProvider{
 		PipePath:   pipePath,
-		UseTPM:     useTPM,
-		tpmStorage: tpm.NewTPMStorage(),
+		UseTPM:     tpmStorage != nil,
+		tpmStorage: tpmStorage,
 	}
 }
 
@@ -33,24 +35,38 @@ func (p *PipeProvider) Get(ctx context.Context) (string, error) {
 			p.cachedKey = key
 			return key, nil
 		}
+		if err != nil && !errors.Is(err, tpm.ErrIndexNotDefined) {
+			return "", fmt.Errorf("failed to retrieve key from TPM: %w", err)
+		}
 	}
 
 	if p.cachedKey != "" {
 		return p.cachedKey, nil
 	}
 
-	if err := os.MkdirAll("/tmp", 0755); err != nil {
-		return "", fmt.Errorf("failed to create /tmp directory: %w", err)
+	key, err := p.readPipe(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	if _, err := os.Stat(p.PipePath); os.IsNotExist(err) {
-		if err := os.Remove(p.PipePath); err != nil && !os.IsNotExist(err) {
-			return "", fmt.Errorf("failed to remove existing pipe: %w", err)
-		}
-		if err := syscall.Mkfifo(p.PipePath, 0600); err != nil {
-			return "", fmt.Errorf("failed to create named pipe: %w", err)
+	p.cachedKey = key
+	if p.UseTPM && p.tpmStorage.Available() {
+		if err := p.tpmStorage.Store(key); err != nil {
+			log.Printf("Warning: Failed to store key in TPM: %v", err)
 		}
 	}
+	return key, nil
+}
+
+// NextKey waits for the replacement passphrase on the pipe.
+func (p *PipeProvider) NextKey(ctx context.Context) (string, error) {
+	return p.readPipe(ctx)
+}
+
+func (p *PipeProvider) readPipe(ctx context.Context) (string, error) {
+	if err := createPipe(p.PipePath); err != nil {
+		return "", err
+	}
 
 	log.Printf("Waiting for key on named pipe %s", p.PipePath)
 
@@ -72,12 +88,6 @@ func (p *PipeProvider) Get(ctx context.Context) (string, error) {
 	case err := <-errChan:
 		return "", fmt.Errorf("failed to read from pipe: %w", err)
 	case key := <-keyChan:
-		p.cachedKey = key
-		if p.UseTPM && p.tpmStorage.Available() {
-			if err := p.tpmStorage.Store(key); err != nil {
-				log.Printf("Warning: Failed to store key in TPM: %v", err)
-			}
-		}
 		return key, nil
 	}
 }
@@ -89,3 +99,20 @@ func (p *PipeProvider) Store(key string) error {
 	}
 	return nil
 }
+
+func createPipe(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", filepath.Dir(path), err)
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove existing pipe: %w", err)
+		}
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return fmt.Errorf("failed to create named pipe: %w", err)
+		}
+	}
+
+	return nil
+}
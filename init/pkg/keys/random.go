@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -18,11 +19,11 @@ type RandomProvider struct {
 	cachedKey  string
 }
 
-func NewRandomProvider(size int, useTPM bool) *RandomProvider {
+func NewRandomProvider(size int, tpmStorage *tpm.TPMStorage) *RandomProvider {
 	return &RandomProvider{
 		Size:       size,
-		UseTPM:     useTPM,
-		tpmStorage: tpm.NewTPMStorage(),
+		UseTPM:     tpmStorage != nil,
+		tpmStorage: tpmStorage,
 	}
 }
 
@@ -34,6 +35,9 @@ func (r *RandomProvider) Get(ctx context.Context) (string, error) {
 			r.cachedKey = key
 			return key, nil
 		}
+		if err != nil && !errors.Is(err, tpm.ErrIndexNotDefined) {
+			return "", fmt.Errorf("failed to retrieve key from TPM: %w", err)
+		}
 		log.Printf("No existing key in TPM, generating new one: %v", err)
 	}
 
@@ -65,6 +69,10 @@ func (r *RandomProvider) Store(key string) error {
 	return nil
 }
 
+func (r *RandomProvider) NextKey(ctx context.Context) (string, error) {
+	return r.generateKey()
+}
+
 func (r *RandomProvider) generateKey() (string, error) {
 	var key []byte
 
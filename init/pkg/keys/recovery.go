@@ -0,0 +1,64 @@
+package keys
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+const recoveryKeyInfo = "tdx-init recovery key v1"
+
+// EscrowedKey is the recovery key of a disk encrypted to one operator. It
+// is printed at format time and kept in the disk's LUKS header.
+type EscrowedKey struct {
+	Disk     string   `json:"disk"`
+	Operator string   `json:"operator"`
+	Key      Envelope `json:"key"`
+}
+
+// NewRecoveryKey generates a random recovery passphrase.
+func NewRecoveryKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate recovery key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// EscrowRecoveryKey encrypts key to each operator, given as base64 X25519
+// public keys.
+func EscrowRecoveryKey(disk, key string, operatorKeys []string) ([]EscrowedKey, error) {
+	values := make([]interface{}, len(operatorKeys))
+	for i, operator := range operatorKeys {
+		values[i] = operator
+	}
+	operators, err := parseOperatorKeys(values)
+	if err != nil {
+		return nil, err
+	}
+
+	escrowed := make([]EscrowedKey, 0, len(operators))
+	for i, operator := range operators {
+		envelope, err := sealEnvelope(operator, []byte(key), recoveryKeyInfo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt recovery key to operator %d: %w", i, err)
+		}
+		escrowed = append(escrowed, EscrowedKey{
+			Disk:     disk,
+			Operator: base64.StdEncoding.EncodeToString(operator.Bytes()),
+			Key:      envelope,
+		})
+	}
+	return escrowed, nil
+}
+
+// OpenRecoveryKey decrypts an EscrowedKey with the operator's X25519 private
+// key and returns the recovery key to pass to 'tdx-init recover disk'.
+func OpenRecoveryKey(private *ecdh.PrivateKey, escrowed EscrowedKey) (string, error) {
+	plaintext, err := openEnvelope(private, escrowed.Key, recoveryKeyInfo)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt recovery key: %w", err)
+	}
+	return string(plaintext), nil
+}
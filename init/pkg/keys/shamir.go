@@ -0,0 +1,419 @@
+package keys
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/attestation"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/shamir"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
+)
+
+const (
+	shareKeyInfo = "tdx-init shamir share v1"
+	sharePrefix  = "tdxshare1"
+	// maxShareBuckets bounds how many keys shares are held for at once
+	maxShareBuckets = 16
+)
+
+// ShamirProvider rebuilds the key from threshold-of-n shares delivered over
+// named pipes and/or HTTPS POSTs. When a disk is formatted it generates a new
+// key and prints one share per operator, encrypted to that operator's
+// X25519 public key, so no single share holder can unlock the disk. The
+// share server uses an attested TLS certificate, as the https strategy does.
+type ShamirProvider struct {
+	Threshold    int
+	OperatorKeys []*ecdh.PublicKey
+	SharePipes   []string
+	ShareServer  string
+	KeySize      int
+	UseTPM       bool
+	Quoter       attestation.QuoteProvider
+	tpmStorage   *tpm.TPMStorage
+	cachedKey    string
+}
+
+// SharedKey is what an operator receives: their share, still encrypted.
+type SharedKey struct {
+	Operator string   `json:"operator"`
+	Share    Envelope `json:"share"`
+}
+
+type shareSubmission struct {
+	share  string
+	result chan error
+}
+
+// shareCollector sorts received shares by the key fingerprint they carry, so
+// shares of another key, sent by mistake or to block unlocking, only fill
+// their own bucket. The key is rebuilt from the first bucket to reach the
+// threshold whose shares combine to its fingerprint. At most
+// maxShareBuckets buckets are kept, the oldest being dropped to make room,
+// and a bucket never holds more than threshold shares of one length.
+type shareCollector struct {
+	threshold int
+	buckets   map[string]map[byte]shamir.Share
+	order     []string
+}
+
+func NewShamirProvider(threshold int, operatorKeys []*ecdh.PublicKey, sharePipes []string, shareServer string, quoter attestation.QuoteProvider, tpmStorage *tpm.TPMStorage) *ShamirProvider {
+	return &ShamirProvider{
+		Threshold:    threshold,
+		OperatorKeys: operatorKeys,
+		SharePipes:   sharePipes,
+		ShareServer:  shareServer,
+		KeySize:      64,
+		UseTPM:       tpmStorage != nil,
+		Quoter:       quoter,
+		tpmStorage:   tpmStorage,
+	}
+}
+
+func (s *ShamirProvider) Get(ctx context.Context) (string, error) {
+	if s.UseTPM && s.tpmStorage.Available() {
+		key, err := s.tpmStorage.Retrieve()
+		if err == nil && key != "" {
+			log.Println("Retrieved existing key from TPM")
+			s.cachedKey = key
+			return key, nil
+		}
+		if err != nil && !errors.Is(err, tpm.ErrIndexNotDefined) {
+			return "", fmt.Errorf("failed to retrieve key from TPM: %w", err)
+		}
+	}
+
+	if s.cachedKey != "" {
+		return s.cachedKey, nil
+	}
+
+	key, err := s.collectShares(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	s.cachedKey = key
+	if s.UseTPM && s.tpmStorage.Available() {
+		if err := s.tpmStorage.Store(key); err != nil {
+			log.Printf("Warning: Failed to store key in TPM: %v", err)
+		}
+	}
+
+	return key, nil
+}
+
+func (s *ShamirProvider) Generate(ctx context.Context) (string, error) {
+	key, err := s.NextKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.Store(key); err != nil {
+		log.Printf("Warning: Failed to store key in TPM: %v", err)
+	}
+
+	return key, nil
+}
+
+// NextKey generates a new key and prints its shares without storing it.
+func (s *ShamirProvider) NextKey(ctx context.Context) (string, error) {
+	if len(s.OperatorKeys) < s.Threshold {
+		return "", fmt.Errorf("generating shares needs at least %d operator keys, have %d", s.Threshold, len(s.OperatorKeys))
+	}
+
+	raw := make([]byte, s.KeySize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate random key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(raw)
+
+	shares, err := shamir.Split([]byte(key), len(s.OperatorKeys), s.Threshold)
+	if err != nil {
+		return "", fmt.Errorf("failed to split key: %w", err)
+	}
+
+	fingerprint := shareFingerprint(key)
+	log.Printf("Generated new key split into %d shares, %d required to unlock", len(shares), s.Threshold)
+	for i, share := range shares {
+		operator := s.OperatorKeys[i]
+		envelope, err := sealEnvelope(operator, []byte(encodeShare(fingerprint, share)), shareKeyInfo)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt share %d: %w", share.X, err)
+		}
+		out, err := json.Marshal(SharedKey{
+			Operator: base64.StdEncoding.EncodeToString(operator.Bytes()),
+			Share:    envelope,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal share %d: %w", share.X, err)
+		}
+		fmt.Fprintf(os.Stdout, "TDX_INIT_SHARE %s\n", out)
+	}
+
+	return key, nil
+}
+
+func (s *ShamirProvider) Store(key string) error {
+	s.cachedKey = key
+	if s.UseTPM && s.tpmStorage.Available() {
+		return s.tpmStorage.Store(key)
+	}
+	return nil
+}
+
+func (s *ShamirProvider) collectShares(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	submissions := make(chan shareSubmission)
+	errChan := make(chan error, len(s.SharePipes)+1)
+
+	for _, pipePath := range s.SharePipes {
+		if err := createPipe(pipePath); err != nil {
+			return "", err
+		}
+		go s.readSharePipe(ctx, pipePath, submissions, errChan)
+	}
+
+	if s.ShareServer != "" {
+		attested, err := attestation.NewAttestedTLS(s.Quoter, "tdx-init")
+		if err != nil {
+			return "", err
+		}
+		server := s.shareServer(attested, submissions)
+		go func() {
+			if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("share server error: %w", err)
+			}
+		}()
+		defer server.Shutdown(context.Background())
+		log.Printf("Waiting for key shares on https://%s/share (TLS public key sha256 %s)", s.ShareServer, attested.SPKIFingerprint())
+	}
+
+	log.Printf("Waiting for %d key shares", s.Threshold)
+
+	collector := newShareCollector(s.Threshold)
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case err := <-errChan:
+			return "", err
+		case sub := <-submissions:
+			key, err := collector.add(sub.share)
+			if err != nil {
+				log.Printf("Rejected key share: %v", err)
+			}
+			sub.result <- err
+			if key != "" {
+				log.Println("Reconstructed key from shares")
+				return key, nil
+			}
+		}
+	}
+}
+
+func newShareCollector(threshold int) *shareCollector {
+	return &shareCollector{
+		threshold: threshold,
+		buckets:   make(map[string]map[byte]shamir.Share),
+	}
+}
+
+// add files an encoded share and returns the key once its bucket is
+// complete. A complete bucket that does not combine to its fingerprint holds
+// a forged or corrupted share; it is dropped and an error returned.
+func (c *shareCollector) add(encoded string) (string, error) {
+	fingerprint, share, err := decodeShare(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	bucket, ok := c.buckets[fingerprint]
+	if !ok {
+		if len(c.order) >= maxShareBuckets {
+			oldest := c.order[0]
+			log.Printf("Too many keys with pending shares, dropping %d share(s) of key %s", len(c.buckets[oldest]), oldest)
+			c.drop(oldest)
+		}
+		bucket = make(map[byte]shamir.Share)
+		c.buckets[fingerprint] = bucket
+		c.order = append(c.order, fingerprint)
+	}
+	if _, ok := bucket[share.X]; ok {
+		return "", fmt.Errorf("share %d of key %s already received", share.X, fingerprint)
+	}
+	for _, other := range bucket {
+		if len(other.Y) != len(share.Y) {
+			return "", fmt.Errorf("share %d of key %s has length %d, want %d", share.X, fingerprint, len(share.Y), len(other.Y))
+		}
+		break
+	}
+	bucket[share.X] = share
+	log.Printf("Accepted key share %d of key %s (%d/%d)", share.X, fingerprint, len(bucket), c.threshold)
+
+	if len(bucket) < c.threshold {
+		return "", nil
+	}
+
+	c.drop(fingerprint)
+	collected := make([]shamir.Share, 0, len(bucket))
+	for _, share := range bucket {
+		collected = append(collected, share)
+	}
+	secret, err := shamir.Combine(collected)
+	if err != nil {
+		return "", fmt.Errorf("failed to combine shares of key %s, discarding them: %w", fingerprint, err)
+	}
+	key := string(secret)
+	if subtle.ConstantTimeCompare([]byte(shareFingerprint(key)), []byte(fingerprint)) != 1 {
+		return "", fmt.Errorf("shares of key %s do not combine to it, discarding them", fingerprint)
+	}
+	return key, nil
+}
+
+func (c *shareCollector) drop(fingerprint string) {
+	delete(c.buckets, fingerprint)
+	for i, f := range c.order {
+		if f == fingerprint {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// readSharePipe keeps reopening the pipe so one pipe can carry several
+// shares, one per writer.
+func (s *ShamirProvider) readSharePipe(ctx context.Context, pipePath string, submissions chan<- shareSubmission, errChan chan<- error) {
+	log.Printf("Waiting for key share on named pipe %s", pipePath)
+	for ctx.Err() == nil {
+		data, err := os.ReadFile(pipePath)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to read from pipe %s: %w", pipePath, err)
+			return
+		}
+		if strings.TrimSpace(string(data)) == "" {
+			continue
+		}
+		sub := shareSubmission{share: string(data), result: make(chan error, 1)}
+		select {
+		case submissions <- sub:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *ShamirProvider) shareServer(attested *attestation.AttestedTLS, submissions chan<- shareSubmission) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/attestation", attested.ServeEvidence)
+	mux.HandleFunc("/share", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprint(w, "Only POST method is allowed")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error reading request: %v", err)
+			return
+		}
+
+		sub := shareSubmission{share: string(body), result: make(chan error, 1)}
+		select {
+		case submissions <- sub:
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := <-sub.result; err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Share rejected: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Share accepted")
+	})
+
+	return &http.Server{
+		Addr:              s.ShareServer,
+		Handler:           mux,
+		TLSConfig:         attested.TLSConfig(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+}
+
+// shareFingerprint identifies the key a share belongs to without revealing
+// anything useful about a random key.
+func shareFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodeShare(fingerprint string, share shamir.Share) string {
+	data := append([]byte{share.X}, share.Y...)
+	return fmt.Sprintf("%s:%s:%s", sharePrefix, fingerprint, base64.StdEncoding.EncodeToString(data))
+}
+
+func decodeShare(encoded string) (string, shamir.Share, error) {
+	parts := strings.Split(strings.TrimSpace(encoded), ":")
+	if len(parts) != 3 || parts[0] != sharePrefix {
+		return "", shamir.Share{}, fmt.Errorf("invalid share format")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(data) < 2 {
+		return "", shamir.Share{}, fmt.Errorf("invalid share encoding")
+	}
+
+	return parts[1], shamir.Share{X: data[0], Y: data[1:]}, nil
+}
+
+// OpenShare decrypts a SharedKey with the operator's X25519 private key and
+// returns the share string to submit.
+func OpenShare(private *ecdh.PrivateKey, shared SharedKey) (string, error) {
+	plaintext, err := openEnvelope(private, shared.Share, shareKeyInfo)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt share: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+func parseOperatorKeys(values []interface{}) ([]*ecdh.PublicKey, error) {
+	keys := make([]*ecdh.PublicKey, 0, len(values))
+	for i, value := range values {
+		encoded, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("operator_keys[%d] must be a string", i)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("operator_keys[%d] is not valid base64: %w", i, err)
+		}
+		key, err := ecdh.X25519().NewPublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("operator_keys[%d] is not an X25519 public key: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
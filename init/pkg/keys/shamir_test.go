@@ -0,0 +1,155 @@
+package keys
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/shamir"
+)
+
+// splitKey returns the encoded shares of key as operators would submit them.
+func splitKey(t *testing.T, key string, n, k int) []string {
+	t.Helper()
+	shares, err := shamir.Split([]byte(key), n, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := make([]string, len(shares))
+	for i, share := range shares {
+		encoded[i] = encodeShare(shareFingerprint(key), share)
+	}
+	return encoded
+}
+
+func TestShareCollectorRebuildsKey(t *testing.T) {
+	shares := splitKey(t, "disk-key", 3, 2)
+	collector := newShareCollector(2)
+
+	if key, err := collector.add(shares[2]); err != nil || key != "" {
+		t.Fatalf("add(first) = %q, %v, want pending", key, err)
+	}
+	if _, err := collector.add(shares[2]); err == nil {
+		t.Fatal("add(duplicate) succeeded, want error")
+	}
+	key, err := collector.add(shares[0] + "\n")
+	if err != nil {
+		t.Fatalf("add(second): %v", err)
+	}
+	if key != "disk-key" {
+		t.Fatalf("add(second) = %q, want %q", key, "disk-key")
+	}
+}
+
+func TestShareCollectorIgnoresSharesOfOtherKeys(t *testing.T) {
+	genuine := splitKey(t, "disk-key", 3, 2)
+	bogus := splitKey(t, "attacker-key", 3, 2)
+	collector := newShareCollector(2)
+
+	// A share of another key arriving first must not pin its fingerprint.
+	if key, err := collector.add(bogus[0]); err != nil || key != "" {
+		t.Fatalf("add(bogus) = %q, %v, want pending", key, err)
+	}
+	if key, err := collector.add(genuine[0]); err != nil || key != "" {
+		t.Fatalf("add(genuine[0]) = %q, %v, want pending", key, err)
+	}
+	key, err := collector.add(genuine[1])
+	if err != nil {
+		t.Fatalf("add(genuine[1]): %v", err)
+	}
+	if key != "disk-key" {
+		t.Fatalf("add(genuine[1]) = %q, want %q", key, "disk-key")
+	}
+}
+
+func TestShareCollectorDiscardsForgedBucket(t *testing.T) {
+	genuine := splitKey(t, "disk-key", 3, 2)
+	fingerprint, _, err := decodeShare(genuine[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := splitKey(t, "evil-key", 3, 2)
+	_, forgedShare, err := decodeShare(forged[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := newShareCollector(2)
+
+	// A forged share naming the real fingerprint completes a bucket that
+	// does not combine to it; the bucket is dropped and unlocking goes on.
+	if _, err := collector.add(genuine[0]); err != nil {
+		t.Fatalf("add(genuine[0]): %v", err)
+	}
+	key, err := collector.add(encodeShare(fingerprint, forgedShare))
+	if err == nil || !strings.Contains(err.Error(), "do not combine") {
+		t.Fatalf("add(forged) = %q, %v, want combine error", key, err)
+	}
+
+	for i, share := range genuine[1:] {
+		key, err = collector.add(share)
+		if err != nil {
+			t.Fatalf("add(genuine[%d]): %v", i+1, err)
+		}
+	}
+	if key != "disk-key" {
+		t.Fatalf("key = %q, want %q", key, "disk-key")
+	}
+}
+
+func TestShareCollectorRejectsMalformedShares(t *testing.T) {
+	collector := newShareCollector(2)
+	for _, share := range []string{"", "tdxshare1:abc", "other:abc:AQI=", "tdxshare1:abc:!!", "tdxshare1:abc:AQ=="} {
+		if _, err := collector.add(share); err == nil {
+			t.Fatalf("add(%q) succeeded, want error", share)
+		}
+	}
+}
+
+func TestShareCollectorBoundsBuckets(t *testing.T) {
+	genuine := splitKey(t, "disk-key", 3, 2)
+	collector := newShareCollector(2)
+
+	if _, err := collector.add(genuine[0]); err != nil {
+		t.Fatalf("add(genuine[0]): %v", err)
+	}
+	for i := 0; i < 2*maxShareBuckets; i++ {
+		bogus := splitKey(t, fmt.Sprintf("bogus-key-%d", i), 3, 2)
+		if _, err := collector.add(bogus[0]); err != nil {
+			t.Fatalf("add(bogus %d): %v", i, err)
+		}
+	}
+	if len(collector.buckets) != maxShareBuckets || len(collector.order) != maxShareBuckets {
+		t.Fatalf("holding %d buckets, want %d", len(collector.buckets), maxShareBuckets)
+	}
+
+	// The genuine bucket was dropped as the oldest; resubmitting rebuilds it
+	for i, share := range genuine[:2] {
+		key, err := collector.add(share)
+		if err != nil {
+			t.Fatalf("add(genuine[%d]): %v", i, err)
+		}
+		if i == 1 && key != "disk-key" {
+			t.Fatalf("key = %q, want %q", key, "disk-key")
+		}
+	}
+}
+
+func TestShareCollectorRejectsMismatchedShareLength(t *testing.T) {
+	genuine := splitKey(t, "disk-key", 3, 2)
+	fingerprint, share, err := decodeShare(genuine[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := newShareCollector(2)
+
+	if _, err := collector.add(genuine[0]); err != nil {
+		t.Fatalf("add(genuine[0]): %v", err)
+	}
+	share.Y = append(share.Y, 0)
+	if _, err := collector.add(encodeShare(fingerprint, share)); err == nil || !strings.Contains(err.Error(), "has length") {
+		t.Fatalf("add(long share) = %v, want length error", err)
+	}
+	if key, err := collector.add(genuine[1]); err != nil || key != "disk-key" {
+		t.Fatalf("add(genuine[1]) = %q, %v, want %q", key, err, "disk-key")
+	}
+}
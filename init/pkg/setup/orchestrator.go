@@ -2,13 +2,17 @@ package setup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"sort"
 
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/disks"
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/keys"
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/ssh"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/tpm"
 )
 
 type Orchestrator struct {
@@ -50,6 +54,9 @@ func (o *Orchestrator) Setup(ctx context.Context) error {
 	for _, diskName := range disksToSetup {
 		log.Printf("Setting up disk: %s", diskName)
 		if err := o.diskManager.SetupDisk(ctx, diskName); err != nil {
+			if errors.Is(err, tpm.ErrUnsealFailed) {
+				log.Printf("TPM refused to release the key for disk %s; the boot chain does not match the sealed PCR policy", diskName)
+			}
 			return fmt.Errorf("failed to setup disk %s: %w", diskName, err)
 		}
 	}
@@ -63,6 +70,57 @@ func (o *Orchestrator) Setup(ctx context.Context) error {
 	return nil
 }
 
+// Plan writes what Setup would do for each disk, which keys it would wait
+// on and how it would obtain SSH keys, without changing any disk or file.
+// It returns an error if Setup would fail.
+func (o *Orchestrator) Plan(w io.Writer) error {
+	var failed []string
+	storeFormatted := false
+	usedKeys := make(map[string]bool)
+
+	for _, diskName := range o.getDisksInOrder() {
+		plan := o.diskManager.PlanDisk(diskName)
+		if plan.DevicePath != "" {
+			fmt.Fprintf(w, "disk %s (%s):\n", diskName, plan.DevicePath)
+		} else {
+			fmt.Fprintf(w, "disk %s:\n", diskName)
+		}
+		for _, action := range plan.Actions {
+			fmt.Fprintf(w, "  %s\n", action)
+		}
+		if plan.Err != nil {
+			fmt.Fprintf(w, "  FAIL: %v\n", plan.Err)
+			failed = append(failed, diskName)
+		}
+
+		if diskName == o.config.SSH.StoreAt {
+			storeFormatted = plan.Formats
+		}
+		if key := o.config.Disks[diskName].EncryptionKey; key != "" {
+			usedKeys[key] = true
+		}
+	}
+
+	var keyNames []string
+	for name := range usedKeys {
+		keyNames = append(keyNames, name)
+	}
+	sort.Strings(keyNames)
+	for _, name := range keyNames {
+		fmt.Fprintf(w, "key %s: %s\n", name, keys.DescribeSource(o.config.Keys[name]))
+	}
+
+	fmt.Fprintln(w, "ssh:")
+	for _, action := range o.sshManager.Plan(storeFormatted) {
+		fmt.Fprintf(w, "  %s\n", action)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("setup would fail for disk(s) %v", failed)
+	}
+	return nil
+}
+
 func (o *Orchestrator) getDisksInOrder() []string {
 	var order []string
 
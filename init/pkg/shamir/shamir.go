@@ -0,0 +1,126 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Share is one point of the sharing polynomials. X is shared by every byte
+// of the secret; Y holds one evaluation per secret byte.
+type Share struct {
+	X byte
+	Y []byte
+}
+
+// Split divides secret into n shares, any k of which recover it.
+func Split(secret []byte, n, k int) ([]Share, error) {
+	if k < 2 {
+		return nil, fmt.Errorf("threshold must be at least 2")
+	}
+	if n < k {
+		return nil, fmt.Errorf("share count %d is below threshold %d", n, k)
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("share count %d exceeds 255", n)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret is empty")
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+
+	coeffs := make([]byte, k)
+	for b, s := range secret {
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, fmt.Errorf("failed to generate coefficients: %w", err)
+		}
+		for i := range shares {
+			shares[i].Y[b] = evaluate(coeffs, shares[i].X)
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine recovers the secret from at least threshold distinct shares.
+// Fewer or foreign shares yield a wrong secret rather than an error, so
+// callers need their own integrity check.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("at least 2 shares are required")
+	}
+
+	size := len(shares[0].Y)
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if share.X == 0 {
+			return nil, fmt.Errorf("invalid share index 0")
+		}
+		if seen[share.X] {
+			return nil, fmt.Errorf("duplicate share index %d", share.X)
+		}
+		seen[share.X] = true
+		if len(share.Y) != size {
+			return nil, fmt.Errorf("shares have different lengths")
+		}
+	}
+
+	secret := make([]byte, size)
+	for b := range secret {
+		var value byte
+		for i, si := range shares {
+			// Lagrange basis polynomial for share i evaluated at x = 0.
+			basis := byte(1)
+			for j, sj := range shares {
+				if i == j {
+					continue
+				}
+				basis = mul(basis, div(sj.X, sj.X^si.X))
+			}
+			value ^= mul(si.Y[b], basis)
+		}
+		secret[b] = value
+	}
+
+	return secret, nil
+}
+
+// evaluate computes the polynomial at x with Horner's method over GF(2^8).
+func evaluate(coeffs []byte, x byte) byte {
+	var result byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coeffs[i]
+	}
+	return result
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1.
+// It runs in constant time regardless of the operands.
+func mul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		carry := -(a >> 7) & 0x1b
+		a = (a << 1) ^ carry
+		b >>= 1
+	}
+	return product
+}
+
+func div(a, b byte) byte {
+	return mul(a, inverse(b))
+}
+
+// inverse uses a^254 = a^-1 in GF(2^8).
+func inverse(a byte) byte {
+	result := a
+	for i := 0; i < 6; i++ {
+		result = mul(result, result)
+		result = mul(result, a)
+	}
+	return mul(result, result)
+}
@@ -0,0 +1,136 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+func randomSecret(t *testing.T, size int) []byte {
+	t.Helper()
+	secret := make([]byte, size)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// subsets returns every size-element subset of shares.
+func subsets(shares []Share, size int) [][]Share {
+	if size == 0 {
+		return [][]Share{nil}
+	}
+	var result [][]Share
+	for i := 0; i <= len(shares)-size; i++ {
+		for _, rest := range subsets(shares[i+1:], size-1) {
+			result = append(result, append([]Share{shares[i]}, rest...))
+		}
+	}
+	return result
+}
+
+func TestSplitCombineRoundTrip(t *testing.T) {
+	for n := 2; n <= 6; n++ {
+		for k := 2; k <= n; k++ {
+			t.Run(fmt.Sprintf("%d-of-%d", k, n), func(t *testing.T) {
+				secret := randomSecret(t, 32)
+				shares, err := Split(secret, n, k)
+				if err != nil {
+					t.Fatalf("Split: %v", err)
+				}
+				if len(shares) != n {
+					t.Fatalf("Split returned %d shares, want %d", len(shares), n)
+				}
+
+				for size := k; size <= n; size++ {
+					for _, subset := range subsets(shares, size) {
+						got, err := Combine(subset)
+						if err != nil {
+							t.Fatalf("Combine(%d shares): %v", size, err)
+						}
+						if !bytes.Equal(got, secret) {
+							t.Fatalf("Combine(%d shares) did not recover the secret", size)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCombineBelowThreshold(t *testing.T) {
+	for n := 3; n <= 6; n++ {
+		for k := 3; k <= n; k++ {
+			t.Run(fmt.Sprintf("%d-of-%d", k, n), func(t *testing.T) {
+				secret := randomSecret(t, 32)
+				shares, err := Split(secret, n, k)
+				if err != nil {
+					t.Fatalf("Split: %v", err)
+				}
+
+				for _, subset := range subsets(shares, k-1) {
+					got, err := Combine(subset)
+					if err != nil {
+						t.Fatalf("Combine(%d shares): %v", k-1, err)
+					}
+					if bytes.Equal(got, secret) {
+						t.Fatalf("Combine(%d shares) recovered the secret below threshold %d", k-1, k)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCombineRejectsInvalidShares(t *testing.T) {
+	shares, err := Split(randomSecret(t, 16), 3, 2)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		shares []Share
+	}{
+		{"single share", shares[:1]},
+		{"duplicate index", []Share{shares[0], shares[1], {X: shares[0].X, Y: shares[2].Y}}},
+		{"index zero", []Share{shares[0], {X: 0, Y: shares[1].Y}}},
+		{"different lengths", []Share{shares[0], {X: shares[1].X, Y: shares[1].Y[1:]}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Combine(tt.shares); err == nil {
+				t.Fatal("Combine succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestSplitRejectsInvalidParameters(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret []byte
+		n, k   int
+	}{
+		{"threshold below 2", []byte("secret"), 3, 1},
+		{"fewer shares than threshold", []byte("secret"), 2, 3},
+		{"more than 255 shares", []byte("secret"), 256, 2},
+		{"empty secret", nil, 3, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Split(tt.secret, tt.n, tt.k); err == nil {
+				t.Fatal("Split succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := mul(byte(a), inverse(byte(a))); got != 1 {
+			t.Fatalf("%d * inverse(%d) = %d, want 1", a, a, got)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// SignatureNamespace is the ssh-keygen -Y namespace operators sign with.
+	SignatureNamespace = "tdx-init"
+	sshsigMagic        = "SSHSIG"
+	maxPendingNonces   = 64
+)
+
+// SignedKeySubmission is the POST body expected when trusted signers are
+// configured. Signature is an armored SSHSIG over SignedMessage(Nonce, Key).
+type SignedKeySubmission struct {
+	Key       string `json:"key"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+// SignedMessage is the exact byte string a submission's signature covers.
+func SignedMessage(nonce, key string) []byte {
+	return []byte(nonce + "\n" + key)
+}
+
+func ParseTrustedSigners(values []interface{}) ([]gossh.PublicKey, error) {
+	signers := make([]gossh.PublicKey, 0, len(values))
+	for i, value := range values {
+		line, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("trusted_signers[%d] must be a string", i)
+		}
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("trusted_signers[%d] is not an OpenSSH public key: %w", i, err)
+		}
+		signers = append(signers, key)
+	}
+	return signers, nil
+}
+
+// VerifySSHSignature checks an armored SSHSIG over message and returns the
+// signing key if it is one of trusted.
+func VerifySSHSignature(armored string, message []byte, trusted []gossh.PublicKey) (gossh.PublicKey, error) {
+	block, _ := pem.Decode([]byte(armored))
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, fmt.Errorf("signature is not an armored SSH signature")
+	}
+
+	blob := block.Bytes
+	if !bytes.HasPrefix(blob, []byte(sshsigMagic)) {
+		return nil, fmt.Errorf("signature has no SSHSIG preamble")
+	}
+
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := gossh.Unmarshal(blob[len(sshsigMagic):], &sig); err != nil {
+		return nil, fmt.Errorf("failed to parse signature: %w", err)
+	}
+	if sig.Version != 1 {
+		return nil, fmt.Errorf("unsupported signature version %d", sig.Version)
+	}
+	if sig.Namespace != SignatureNamespace {
+		return nil, fmt.Errorf("signature namespace %q, expected %q", sig.Namespace, SignatureNamespace)
+	}
+
+	signer, err := gossh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer public key: %w", err)
+	}
+
+	trustedSigner := false
+	for _, key := range trusted {
+		if bytes.Equal(key.Marshal(), signer.Marshal()) {
+			trustedSigner = true
+			break
+		}
+	}
+	if !trustedSigner {
+		return nil, fmt.Errorf("signer %s is not trusted", gossh.FingerprintSHA256(signer))
+	}
+
+	var digest []byte
+	switch sig.HashAlgorithm {
+	case "sha256":
+		sum := sha256.Sum256(message)
+		digest = sum[:]
+	case "sha512":
+		sum := sha512.Sum512(message)
+		digest = sum[:]
+	default:
+		return nil, fmt.Errorf("unsupported signature hash %q", sig.HashAlgorithm)
+	}
+
+	signed := append([]byte(sshsigMagic), gossh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, digest})...)
+
+	var signature gossh.Signature
+	if err := gossh.Unmarshal(sig.Signature, &signature); err != nil {
+		return nil, fmt.Errorf("failed to parse signature blob: %w", err)
+	}
+
+	if err := signer.Verify(signed, &signature); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return signer, nil
+}
+
+// VerifySubmission checks a SignedKeySubmission POST body: its nonce must be
+// outstanding in nonces and its signature must verify against trusted. It
+// returns the signed key.
+func VerifySubmission(body []byte, trusted []gossh.PublicKey, nonces *NonceStore) (string, error) {
+	var submission SignedKeySubmission
+	if err := json.Unmarshal(body, &submission); err != nil {
+		return "", fmt.Errorf("invalid request, expected signed key submission: %v", err)
+	}
+	if !nonces.Consume(submission.Nonce) {
+		return "", errors.New("unknown or already used nonce, fetch a new one from /nonce")
+	}
+	signer, err := VerifySSHSignature(submission.Signature, SignedMessage(submission.Nonce, submission.Key), trusted)
+	if err != nil {
+		return "", fmt.Errorf("signature rejected: %v", err)
+	}
+	log.Printf("Key submission signed by %s", gossh.FingerprintSHA256(signer))
+	return submission.Key, nil
+}
+
+// NonceStore hands out single-use nonces. The oldest nonce is dropped once
+// too many are outstanding, so unauthenticated GETs cannot grow it.
+type NonceStore struct {
+	mu      sync.Mutex
+	pending []string
+}
+
+// ServeNonce issues a nonce on GET /nonce.
+func (n *NonceStore) ServeNonce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(w, "Only GET method is allowed")
+		return
+	}
+
+	nonce, err := n.Issue()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	fmt.Fprint(w, nonce)
+}
+
+func (n *NonceStore) Issue() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(raw)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.pending) >= maxPendingNonces {
+		n.pending = n.pending[1:]
+	}
+	n.pending = append(n.pending, nonce)
+	return nonce, nil
+}
+
+func (n *NonceStore) Consume(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, pending := range n.pending {
+		if pending == nonce {
+			n.pending = append(n.pending[:i], n.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
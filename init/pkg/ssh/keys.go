@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"regexp"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const minRSABits = 2048
+
+// legacyKeyPattern matches the bare base64 ed25519 blob older clients POST
+// and older releases stored in the LUKS token.
+var legacyKeyPattern = regexp.MustCompile(`^[A-Za-z0-9+/]{68}$`)
+
+// AuthorizedKey is one authorized_keys entry.
+type AuthorizedKey struct {
+	Key     gossh.PublicKey
+	Comment string
+	Options []string
+}
+
+// ParseAuthorizedKeys parses OpenSSH public-key lines, one per line, with
+// optional authorized_keys options. Blank lines and comments are skipped.
+func ParseAuthorizedKeys(text string) ([]AuthorizedKey, error) {
+	var keys []AuthorizedKey
+
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if legacyKeyPattern.MatchString(line) {
+			line = "ssh-ed25519 " + line
+		}
+
+		key, comment, options, rest, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid OpenSSH public key: %w", i+1, err)
+		}
+		if len(strings.TrimSpace(string(rest))) > 0 {
+			return nil, fmt.Errorf("line %d: trailing data after public key", i+1)
+		}
+		if err := checkKeyStrength(key); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		keys = append(keys, AuthorizedKey{
+			Key:     key,
+			Comment: comment,
+			Options: options,
+		})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found")
+	}
+
+	return keys, nil
+}
+
+func checkKeyStrength(key gossh.PublicKey) error {
+	switch key.Type() {
+	case gossh.KeyAlgoDSA:
+		return fmt.Errorf("ssh-dss keys are not accepted")
+	case gossh.KeyAlgoRSA:
+		cryptoKey, ok := key.(gossh.CryptoPublicKey)
+		if !ok {
+			return nil
+		}
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSABits {
+			return fmt.Errorf("RSA keys must be at least %d bits", minRSABits)
+		}
+	}
+	return nil
+}
+
+// Line returns the key as "type base64 [comment]", without options.
+func (k AuthorizedKey) Line() string {
+	line := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(k.Key)))
+	if k.Comment != "" {
+		line += " " + k.Comment
+	}
+	return line
+}
+
+// Entry returns the authorized_keys line, using the key's own options or
+// defaultOptions when it has none.
+func (k AuthorizedKey) Entry(defaultOptions []string) string {
+	options := k.Options
+	if len(options) == 0 {
+		options = defaultOptions
+	}
+	if len(options) == 0 {
+		return k.Line()
+	}
+	return strings.Join(options, ",") + " " + k.Line()
+}
+
+// String is the storable form: the entry with only the key's own options.
+func (k AuthorizedKey) String() string {
+	return k.Entry(nil)
+}
@@ -6,9 +6,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/attestation"
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/config"
 	"github.com/NethermindEth/nethermind-tdx/init/pkg/disks"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/signing"
 )
 
 type Manager struct {
@@ -18,7 +21,9 @@ type Manager struct {
 }
 
 type KeyProvider interface {
-	WaitForKey(ctx context.Context) (string, error)
+	WaitForKeys(ctx context.Context) ([]string, error)
+	// Describe says where keys are awaited, for a dry run.
+	Describe() string
 }
 
 func NewManager(cfg config.SSHConfig, dm *disks.Manager) (*Manager, error) {
@@ -35,30 +40,30 @@ func NewManager(cfg config.SSHConfig, dm *disks.Manager) (*Manager, error) {
 }
 
 func (sm *Manager) Setup(ctx context.Context) error {
-	var sshKey string
+	var sshKeys []string
 	var err error
 
 	if sm.config.StoreAt != "" {
-		sshKey, err = sm.tryGetStoredKey()
+		sshKeys, err = sm.tryGetStoredKeys()
 		if err != nil {
 			log.Printf("No stored SSH key found: %v", err)
 		}
 	}
 
-	if sshKey == "" {
-		sshKey, err = sm.waitForKey(ctx)
+	if len(sshKeys) == 0 {
+		sshKeys, err = sm.waitForKeys(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to get SSH key: %w", err)
 		}
 
 		if sm.config.StoreAt != "" {
-			if err := sm.storeKeyInDisk(sshKey); err != nil {
+			if err := sm.storeKeysInDisk(sshKeys); err != nil {
 				log.Printf("Warning: Failed to store SSH key in disk: %v", err)
 			}
 		}
 	}
 
-	if err := sm.writeSSHKey(sshKey); err != nil {
+	if err := sm.writeSSHKeys(sshKeys); err != nil {
 		return fmt.Errorf("failed to write SSH key: %w", err)
 	}
 
@@ -66,26 +71,52 @@ func (sm *Manager) Setup(ctx context.Context) error {
 	return nil
 }
 
-func (sm *Manager) tryGetStoredKey() (string, error) {
+// Plan describes what Setup would do. storeFormatted tells whether the
+// store_at disk is about to be formatted, which discards stored keys.
+func (sm *Manager) Plan(storeFormatted bool) []string {
+	var actions []string
+
+	if sm.config.StoreAt != "" && !storeFormatted {
+		keys, err := sm.tryGetStoredKeys()
+		if err == nil && len(keys) > 0 {
+			actions = append(actions, fmt.Sprintf("use %d SSH key(s) stored on disk %s", len(keys), sm.config.StoreAt))
+		}
+	}
+
+	if len(actions) == 0 {
+		actions = append(actions, "wait for SSH keys "+sm.provider.Describe())
+		if sm.config.StoreAt != "" {
+			actions = append(actions, fmt.Sprintf("store them in the LUKS token of disk %s", sm.config.StoreAt))
+		}
+	}
+
+	actions = append(actions, fmt.Sprintf("write %s", filepath.Join(sm.config.Dir, "authorized_keys")))
+	if sm.config.KeyPath != "" {
+		actions = append(actions, fmt.Sprintf("write %s", sm.config.KeyPath))
+	}
+	return actions
+}
+
+func (sm *Manager) tryGetStoredKeys() ([]string, error) {
 	disk, ok := sm.diskManager.GetDisk(sm.config.StoreAt)
 	if !ok {
-		return "", fmt.Errorf("disk %s not found", sm.config.StoreAt)
+		return nil, fmt.Errorf("disk %s not found", sm.config.StoreAt)
 	}
 
 	if disk.DevicePath == "" {
-		return "", fmt.Errorf("disk %s not yet initialized", sm.config.StoreAt)
+		return nil, fmt.Errorf("disk %s not yet initialized", sm.config.StoreAt)
 	}
 
-	key, err := disks.GetSSHToken(disk.DevicePath)
+	keys, err := sm.diskManager.GetSSHToken(disk.DevicePath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	log.Printf("Retrieved SSH key from disk %s", sm.config.StoreAt)
-	return key, nil
+	log.Printf("Retrieved %d SSH key(s) from disk %s", len(keys), sm.config.StoreAt)
+	return keys, nil
 }
 
-func (sm *Manager) storeKeyInDisk(sshKey string) error {
+func (sm *Manager) storeKeysInDisk(sshKeys []string) error {
 	disk, ok := sm.diskManager.GetDisk(sm.config.StoreAt)
 	if !ok {
 		return fmt.Errorf("disk %s not found", sm.config.StoreAt)
@@ -95,37 +126,48 @@ func (sm *Manager) storeKeyInDisk(sshKey string) error {
 		return fmt.Errorf("disk %s not yet initialized", sm.config.StoreAt)
 	}
 
-	if err := disks.StoreSSHToken(disk.DevicePath, sshKey); err != nil {
+	if err := sm.diskManager.StoreSSHToken(disk.DevicePath, sshKeys); err != nil {
 		return fmt.Errorf("failed to store SSH token: %w", err)
 	}
 
-	log.Printf("Stored SSH key in disk %s", sm.config.StoreAt)
+	log.Printf("Stored %d SSH key(s) in disk %s", len(sshKeys), sm.config.StoreAt)
 	return nil
 }
 
-func (sm *Manager) waitForKey(ctx context.Context) (string, error) {
-	return sm.provider.WaitForKey(ctx)
+func (sm *Manager) waitForKeys(ctx context.Context) ([]string, error) {
+	return sm.provider.WaitForKeys(ctx)
 }
 
-func (sm *Manager) writeSSHKey(sshKey string) error {
+// writeSSHKeys writes every key to authorized_keys. Keys submitted with
+// their own options keep them; the rest get the configured key_options.
+func (sm *Manager) writeSSHKeys(sshKeys []string) error {
+	keys, err := ParseAuthorizedKeys(strings.Join(sshKeys, "\n"))
+	if err != nil {
+		return fmt.Errorf("invalid SSH keys: %w", err)
+	}
+
 	if err := os.MkdirAll(sm.config.Dir, 0700); err != nil {
 		return fmt.Errorf("failed to create SSH directory: %w", err)
 	}
 
-	authKeysFile := filepath.Join(sm.config.Dir, "authorized_keys")
-	content := fmt.Sprintf("no-port-forwarding,no-agent-forwarding,no-X11-forwarding ssh-ed25519 %s\n", sshKey)
+	var entries, lines strings.Builder
+	for _, key := range keys {
+		entries.WriteString(key.Entry(sm.config.KeyOptions) + "\n")
+		lines.WriteString(key.Line() + "\n")
+	}
 
-	if err := os.WriteFile(authKeysFile, []byte(content), 0600); err != nil {
+	authKeysFile := filepath.Join(sm.config.Dir, "authorized_keys")
+	if err := os.WriteFile(authKeysFile, []byte(entries.String()), 0600); err != nil {
 		return fmt.Errorf("failed to write authorized_keys: %w", err)
 	}
 
 	if sm.config.KeyPath != "" {
-		if err := os.WriteFile(sm.config.KeyPath, []byte(sshKey), 0600); err != nil {
+		if err := os.WriteFile(sm.config.KeyPath, []byte(lines.String()), 0600); err != nil {
 			return fmt.Errorf("failed to write key file: %w", err)
 		}
 	}
 
-	log.Printf("SSH key written to %s", authKeysFile)
+	log.Printf("%d SSH key(s) written to %s", len(keys), authKeysFile)
 	return nil
 }
 
@@ -136,7 +178,24 @@ func CreateKeyProvider(cfg config.SSHConfig) (KeyProvider, error) {
 		if url, ok := cfg.StrategyConfig["server_url"].(string); ok {
 			serverURL = url
 		}
-		return NewWebServerProvider(serverURL), nil
+		provider := NewWebServerProvider(serverURL)
+		if values, ok := cfg.StrategyConfig["trusted_signers"].([]interface{}); ok && len(values) > 0 {
+			signers, err := signing.ParseTrustedSigners(values)
+			if err != nil {
+				return nil, err
+			}
+			provider.TrustedSigners = signers
+		}
+		// Attested TLS is on unless explicitly turned off, so a deployment
+		// does not serve the key over plain HTTP by omission.
+		if useTLS, _ := cfg.StrategyConfig["tls"].(bool); useTLS || cfg.StrategyConfig["tls"] == nil {
+			quoter, err := attestation.NewQuoteProvider()
+			if err != nil {
+				return nil, fmt.Errorf("attested TLS requires TDX attestation: %w", err)
+			}
+			provider.Quoter = quoter
+		}
+		return provider, nil
 
 	default:
 		return nil, fmt.Errorf("unknown SSH strategy: %s", cfg.Strategy)
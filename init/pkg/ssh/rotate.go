@@ -0,0 +1,154 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ListKeys returns the keys currently authorized. With store_at the LUKS
+// token is authoritative, otherwise authorized_keys is read back. After
+// every key has been removed the list is empty.
+func (sm *Manager) ListKeys() ([]AuthorizedKey, error) {
+	var text string
+
+	if sm.config.StoreAt != "" {
+		disk, err := sm.diskManager.LocateDisk(sm.config.StoreAt)
+		if err != nil {
+			return nil, err
+		}
+		lines, err := sm.diskManager.GetSSHToken(disk.DevicePath)
+		if err != nil {
+			return nil, err
+		}
+		text = strings.Join(lines, "\n")
+	} else {
+		data, err := os.ReadFile(filepath.Join(sm.config.Dir, "authorized_keys"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read authorized_keys: %w", err)
+		}
+		text = string(data)
+	}
+
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return ParseAuthorizedKeys(text)
+}
+
+// AddKeys authorizes the OpenSSH public-key lines in text. Keys that are
+// already authorized are left as they are.
+func (sm *Manager) AddKeys(text string) ([]AuthorizedKey, error) {
+	added, err := ParseAuthorizedKeys(text)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := sm.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var newKeys []AuthorizedKey
+	for _, key := range added {
+		if indexOfKey(current, key.Key) >= 0 || indexOfKey(newKeys, key.Key) >= 0 {
+			log.Printf("SSH key %s is already authorized", gossh.FingerprintSHA256(key.Key))
+			continue
+		}
+		newKeys = append(newKeys, key)
+	}
+
+	if len(newKeys) == 0 {
+		return nil, nil
+	}
+
+	if err := sm.replaceKeys(append(current, newKeys...)); err != nil {
+		return nil, err
+	}
+	return newKeys, nil
+}
+
+// RemoveKeys revokes every key whose SHA256 fingerprint or comment equals
+// selector. Removing the last key locks everyone out, so it is refused
+// unless allowEmpty is set.
+func (sm *Manager) RemoveKeys(selector string, allowEmpty bool) ([]AuthorizedKey, error) {
+	current, err := sm.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var kept, removed []AuthorizedKey
+	for _, key := range current {
+		if gossh.FingerprintSHA256(key.Key) == selector || key.Comment == selector {
+			removed = append(removed, key)
+		} else {
+			kept = append(kept, key)
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil, fmt.Errorf("no authorized key matches %q", selector)
+	}
+	if len(kept) == 0 && !allowEmpty {
+		return nil, fmt.Errorf("refusing to remove the last authorized key")
+	}
+
+	if err := sm.replaceKeys(kept); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// replaceKeys updates the LUKS token first so that a failure there leaves
+// authorized_keys matching what the next boot will restore.
+func (sm *Manager) replaceKeys(keys []AuthorizedKey) error {
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, key.String())
+	}
+
+	if sm.config.StoreAt != "" {
+		disk, err := sm.diskManager.LocateDisk(sm.config.StoreAt)
+		if err != nil {
+			return err
+		}
+		if err := sm.diskManager.StoreSSHToken(disk.DevicePath, lines); err != nil {
+			return fmt.Errorf("failed to store SSH token: %w", err)
+		}
+	}
+
+	if len(lines) == 0 {
+		return sm.clearSSHKeys()
+	}
+	return sm.writeSSHKeys(lines)
+}
+
+func (sm *Manager) clearSSHKeys() error {
+	authKeysFile := filepath.Join(sm.config.Dir, "authorized_keys")
+	if err := os.WriteFile(authKeysFile, nil, 0600); err != nil {
+		return fmt.Errorf("failed to write authorized_keys: %w", err)
+	}
+
+	if sm.config.KeyPath != "" {
+		if err := os.WriteFile(sm.config.KeyPath, nil, 0600); err != nil {
+			return fmt.Errorf("failed to write key file: %w", err)
+		}
+	}
+
+	log.Printf("Removed all SSH keys from %s", authKeysFile)
+	return nil
+}
+
+func indexOfKey(keys []AuthorizedKey, key gossh.PublicKey) int {
+	for i, k := range keys {
+		if bytes.Equal(k.Key.Marshal(), key.Marshal()) {
+			return i
+		}
+	}
+	return -1
+}
@@ -6,11 +6,23 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"regexp"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/attestation"
+	"github.com/NethermindEth/nethermind-tdx/init/pkg/signing"
 )
 
 type WebServerProvider struct {
 	ServerURL string
+	// Quoter, when set, makes the server use attested TLS and serve the
+	// quote binding its TLS key on GET /attestation.
+	Quoter attestation.QuoteProvider
+	// TrustedSigners, when set, requires every submitted key to be signed
+	// by one of these operator keys over a nonce served on GET /nonce.
+	TrustedSigners []gossh.PublicKey
+	nonces         signing.NonceStore
 }
 
 func NewWebServerProvider(serverURL string) *WebServerProvider {
@@ -19,44 +31,85 @@ func NewWebServerProvider(serverURL string) *WebServerProvider {
 	}
 }
 
-func (w *WebServerProvider) WaitForKey(ctx context.Context) (string, error) {
-	keyReceivedChan := make(chan string)
+func (w *WebServerProvider) Describe() string {
+	scheme := "http"
+	if w.Quoter != nil {
+		scheme = "https"
+	}
+	description := fmt.Sprintf("via %s POST on %s", scheme, w.ServerURL)
+	if len(w.TrustedSigners) > 0 {
+		description += fmt.Sprintf(", signed by one of %d trusted signers", len(w.TrustedSigners))
+	}
+	return description
+}
+
+func (w *WebServerProvider) WaitForKeys(ctx context.Context) ([]string, error) {
+	keyReceivedChan := make(chan []string)
 	serverErrChan := make(chan error)
 
+	signers := w.TrustedSigners
+	nonces := &w.nonces
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprint(w, "Only POST method is allowed")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 16384))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error reading request: %v", err)
+			return
+		}
+
+		keys, err := readSubmittedKeys(body, signers, nonces)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+
+		keyReceivedChan <- keys
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%d SSH key(s) received and stored successfully", len(keys))
+	}))
+
+	if len(signers) > 0 {
+		mux.HandleFunc("/nonce", nonces.ServeNonce)
+	}
+
 	server := &http.Server{
-		Addr: w.ServerURL,
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Method != http.MethodPost {
-				w.WriteHeader(http.StatusMethodNotAllowed)
-				fmt.Fprint(w, "Only POST method is allowed")
-				return
-			}
-
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "Error reading request: %v", err)
-				return
-			}
-
-			key := string(body)
-			matched, _ := regexp.MatchString(`^[A-Za-z0-9+/]{68}$`, key)
-			if !matched {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprint(w, "Invalid key format, expected base64-encoded OpenSSH ed25519 public key")
-				return
-			}
-
-			keyReceivedChan <- key
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprint(w, "SSH key received and stored successfully")
-		}),
+		Addr:              w.ServerURL,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
 	}
 
-	log.Printf("Starting web server on %s to receive SSH key", w.ServerURL)
+	if w.Quoter != nil {
+		attested, err := attestation.NewAttestedTLS(w.Quoter, "tdx-init-ssh")
+		if err != nil {
+			return nil, err
+		}
+		mux.HandleFunc("/attestation", attested.ServeEvidence)
+		server.TLSConfig = attested.TLSConfig()
+		log.Printf("Starting attested TLS web server on %s to receive SSH key (TLS public key sha256 %s)", w.ServerURL, attested.SPKIFingerprint())
+	} else {
+		log.Printf("Warning: Starting plain HTTP web server on %s to receive SSH key, tls is disabled", w.ServerURL)
+	}
 
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			serverErrChan <- err
 		}
 	}()
@@ -64,11 +117,38 @@ func (w *WebServerProvider) WaitForKey(ctx context.Context) (string, error) {
 	select {
 	case <-ctx.Done():
 		server.Shutdown(context.Background())
-		return "", ctx.Err()
+		return nil, ctx.Err()
 	case err := <-serverErrChan:
-		return "", fmt.Errorf("server error: %w", err)
-	case key := <-keyReceivedChan:
+		return nil, fmt.Errorf("server error: %w", err)
+	case keys := <-keyReceivedChan:
 		server.Shutdown(context.Background())
-		return key, nil
+		return keys, nil
+	}
+}
+
+// readSubmittedKeys extracts the SSH keys from a POST body, one OpenSSH
+// public-key line per line. Without trusted signers the body is the key
+// list; with them it is a SignedKeySubmission whose nonce must be
+// outstanding and whose signature must verify.
+func readSubmittedKeys(body []byte, signers []gossh.PublicKey, nonces *signing.NonceStore) ([]string, error) {
+	text := string(body)
+
+	if len(signers) > 0 {
+		key, err := signing.VerifySubmission(body, signers, nonces)
+		if err != nil {
+			return nil, err
+		}
+		text = key
+	}
+
+	parsed, err := ParseAuthorizedKeys(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key format, expected OpenSSH public key lines: %v", err)
 	}
-}
\ No newline at end of file
+
+	keys := make([]string, 0, len(parsed))
+	for _, key := range parsed {
+		keys = append(keys, key.String())
+	}
+	return keys, nil
+}
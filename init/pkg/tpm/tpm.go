@@ -2,112 +2,520 @@ package tpm
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
-	"strings"
+	"os"
+	"syscall"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/linuxtpm"
 )
 
 const (
-	DefaultNVIndex = "0x1500016"
-	TCTIDevice     = "device:/dev/tpmrm0"
+	DefaultNVIndex uint32 = 0x1500016
+	TPMDevice             = "/dev/tpmrm0"
+
+	// maxNVChunk stays below the smallest NV_MAX_BUFFER_SIZE seen on
+	// vTPMs so reads and writes never need to query TPM properties.
+	maxNVChunk = 512
+
+	// scratchIndexBit is flipped in a key's NV index to get the index its
+	// replacement is staged in.
+	scratchIndexBit uint32 = 0x00800000
+)
+
+var (
+	ErrNotAvailable    = errors.New("TPM device not available")
+	ErrIndexNotDefined = errors.New("TPM NV index not defined")
+	ErrAuthFailed      = errors.New("TPM authorization failed")
+	ErrDeviceBusy      = errors.New("TPM device busy")
+	ErrUnsealFailed    = errors.New("TPM refused to unseal key, PCR values do not match policy")
 )
 
 type TPMStorage struct {
-	NVIndex string
+	NVIndex uint32
+	// PCRs, when non-empty, seals the NV index to a PolicyPCR over these
+	// SHA-256 PCRs so it can only be read back in the same measured state.
+	PCRs []uint
+	// LegacyNVIndex, when set, is where the key was kept before it got
+	// NVIndex. Retrieve moves a key found only there to NVIndex.
+	LegacyNVIndex uint32
 }
 
-func NewTPMStorage() *TPMStorage {
+func NewTPMStorage(nvIndex uint32) *TPMStorage {
 	return &TPMStorage{
-		NVIndex: DefaultNVIndex,
+		NVIndex: nvIndex,
 	}
 }
 
+func NewSealedTPMStorage(nvIndex uint32, pcrs []uint) *TPMStorage {
+	return &TPMStorage{
+		NVIndex: nvIndex,
+		PCRs:    pcrs,
+	}
+}
+
+func (t *TPMStorage) Sealed() bool {
+	return len(t.PCRs) > 0
+}
+
 func (t *TPMStorage) Available() bool {
-	cmd := exec.Command("test", "-e", "/dev/tpm0")
-	if err := cmd.Run(); err != nil {
+	if _, err := os.Stat("/dev/tpm0"); err != nil {
 		return false
 	}
-	cmd = exec.Command("test", "-e", "/dev/tpmrm0")
-	return cmd.Run() == nil
+	_, err := os.Stat(TPMDevice)
+	return err == nil
 }
 
 func (t *TPMStorage) Store(key string) error {
 	if !t.Available() {
-		return fmt.Errorf("TPM device not available")
+		return ErrNotAvailable
 	}
 
-	keySize := len(key)
-	
-	cmd := exec.Command("tpm2_nvundefine", t.NVIndex)
-	cmd.Env = append(cmd.Environ(), fmt.Sprintf("TPM2TOOLS_TCTI=%s", TCTIDevice))
-	cmd.Run()
+	tpm, err := openTPM()
+	if err != nil {
+		return err
+	}
+	defer tpm.Close()
+
+	return t.store(tpm, key)
+}
 
-	log.Printf("Defining TPM NV index %s with size %d", t.NVIndex, keySize)
-	cmd = exec.Command("tpm2_nvdefine", "-s", fmt.Sprintf("%d", keySize), t.NVIndex)
-	cmd.Env = append(cmd.Environ(), fmt.Sprintf("TPM2TOOLS_TCTI=%s", TCTIDevice))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to define TPM NV index: %w", err)
+func (t *TPMStorage) store(tpm transport.TPM, key string) error {
+	// An index of the same size and policy is overwritten by a single
+	// NV_Write, so a crash leaves either the old or the new key in place.
+	if t.rewritable(tpm, len(key)) {
+		log.Printf("Replacing key in TPM NV index 0x%x", t.NVIndex)
+		if err := t.write(tpm, []byte(key)); err != nil {
+			return fmt.Errorf("failed to write key to TPM: %w", err)
+		}
+		return nil
 	}
 
-	log.Printf("Writing key to TPM NV index %s", t.NVIndex)
-	cmd = exec.Command("tpm2_nvwrite", t.NVIndex, "-i-")
-	cmd.Env = append(cmd.Environ(), fmt.Sprintf("TPM2TOOLS_TCTI=%s", TCTIDevice))
-	cmd.Stdin = bytes.NewBufferString(key)
-	
-	if output, err := cmd.CombinedOutput(); err != nil {
-		t.cleanup()
-		return fmt.Errorf("failed to write key to TPM: %w (output: %s)", err, string(output))
+	if _, err := t.name(tpm); err != nil {
+		if !errors.Is(err, ErrIndexNotDefined) {
+			return fmt.Errorf("failed to read TPM NV index: %w", err)
+		}
+		return t.replace(tpm, []byte(key))
 	}
 
-	log.Printf("Successfully stored key in TPM at index %s", t.NVIndex)
+	// Redefining the index destroys the old key before the new one is
+	// written, so the new key is staged in the scratch index first and
+	// Retrieve finishes the swap if it is interrupted.
+	scratch := t.scratch()
+	log.Printf("Staging key in TPM NV index 0x%x", scratch.NVIndex)
+	if err := scratch.replace(tpm, staged(key)); err != nil {
+		return fmt.Errorf("failed to stage key in TPM: %w", err)
+	}
+	if err := t.replace(tpm, []byte(key)); err != nil {
+		return err
+	}
+	if err := scratch.undefine(tpm); err != nil {
+		log.Printf("Warning: Failed to remove TPM NV index 0x%x: %v", scratch.NVIndex, err)
+	}
 	return nil
 }
 
+// replace defines the index afresh to hold exactly data and writes it.
+func (t *TPMStorage) replace(tpm transport.TPM, data []byte) error {
+	if err := t.undefine(tpm); err != nil && !errors.Is(err, ErrIndexNotDefined) {
+		return fmt.Errorf("failed to remove existing TPM NV index: %w", err)
+	}
+
+	public := tpm2.TPMSNVPublic{
+		NVIndex: tpm2.TPMHandle(t.NVIndex),
+		NameAlg: tpm2.TPMAlgSHA256,
+		Attributes: tpm2.TPMANV{
+			OwnerWrite: true,
+			OwnerRead:  true,
+			AuthWrite:  true,
+			AuthRead:   true,
+			NT:         tpm2.TPMNTOrdinary,
+			NoDA:       true,
+		},
+		DataSize: uint16(len(data)),
+	}
+
+	if t.Sealed() {
+		digest, err := t.policyDigest(tpm)
+		if err != nil {
+			return fmt.Errorf("failed to compute PCR policy: %w", err)
+		}
+		// Owner keeps write access so the key can be replaced, but reads
+		// are only possible through the PCR policy.
+		public.Attributes = tpm2.TPMANV{
+			OwnerWrite: true,
+			PolicyRead: true,
+			NT:         tpm2.TPMNTOrdinary,
+			NoDA:       true,
+		}
+		public.AuthPolicy = tpm2.TPM2BDigest{Buffer: digest}
+		log.Printf("Sealing TPM NV index 0x%x to PCRs %v", t.NVIndex, t.PCRs)
+	}
+
+	log.Printf("Defining TPM NV index 0x%x with size %d", t.NVIndex, len(data))
+	def := tpm2.NVDefineSpace{
+		AuthHandle: tpm2.TPMRHOwner,
+		PublicInfo: tpm2.New2B(public),
+	}
+	if _, err := def.Execute(tpm); err != nil {
+		return fmt.Errorf("failed to define TPM NV index: %w", classify(err))
+	}
+
+	log.Printf("Writing key to TPM NV index 0x%x", t.NVIndex)
+	if err := t.write(tpm, data); err != nil {
+		t.undefine(tpm)
+		return fmt.Errorf("failed to write key to TPM: %w", err)
+	}
+
+	log.Printf("Successfully stored key in TPM at index 0x%x", t.NVIndex)
+	return nil
+}
+
+// ScratchIndex returns the NV index a key for index is staged in while
+// index is redefined.
+func ScratchIndex(index uint32) uint32 {
+	return index ^ scratchIndexBit
+}
+
+func (t *TPMStorage) scratch() *TPMStorage {
+	return &TPMStorage{NVIndex: ScratchIndex(t.NVIndex), PCRs: t.PCRs}
+}
+
+// staged appends the key's SHA-256 so a partly written scratch index is
+// told apart from a complete one.
+func staged(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return append([]byte(key), sum[:]...)
+}
+
+// readStaged returns the key staged by an interrupted store, or nil if the
+// scratch index is missing or was not completely written.
+func (t *TPMStorage) readStaged(tpm transport.TPM) []byte {
+	data, _, err := t.scratch().read(tpm)
+	if err != nil || len(data) <= sha256.Size {
+		return nil
+	}
+	key, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if want := sha256.Sum256(key); !bytes.Equal(sum, want[:]) {
+		return nil
+	}
+	return key
+}
+
+// rewritable reports whether the index exists with room for exactly size
+// bytes in one write and the attributes and policy store would define.
+func (t *TPMStorage) rewritable(tpm transport.TPM, size int) bool {
+	if size > maxNVChunk {
+		return false
+	}
+
+	pub, err := tpm2.NVReadPublic{NVIndex: tpm2.TPMHandle(t.NVIndex)}.Execute(tpm)
+	if err != nil {
+		return false
+	}
+	contents, err := pub.NVPublic.Contents()
+	if err != nil || int(contents.DataSize) != size {
+		return false
+	}
+
+	sealed := contents.Attributes.PolicyRead && !contents.Attributes.OwnerRead
+	if sealed != t.Sealed() {
+		return false
+	}
+	if !sealed {
+		return true
+	}
+
+	digest, err := t.policyDigest(tpm)
+	return err == nil && bytes.Equal(digest, contents.AuthPolicy.Buffer)
+}
+
 func (t *TPMStorage) Retrieve() (string, error) {
 	if !t.Available() {
-		return "", fmt.Errorf("TPM device not available")
+		return "", ErrNotAvailable
 	}
 
-	log.Printf("Reading from TPM NV index %s", t.NVIndex)
-	cmd := exec.Command("tpm2_nvread", t.NVIndex)
-	cmd.Env = append(cmd.Environ(), fmt.Sprintf("TPM2TOOLS_TCTI=%s", TCTIDevice))
-	
-	output, err := cmd.Output()
+	tpm, err := openTPM()
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			stderr := string(exitErr.Stderr)
-			if strings.Contains(stderr, "ERROR") || strings.Contains(stderr, "not found") {
-				return "", fmt.Errorf("no key stored in TPM at index %s", t.NVIndex)
-			}
+		return "", err
+	}
+	defer tpm.Close()
+
+	// A complete staged key is newer than whatever the index holds, which
+	// may be missing or half written.
+	if key := t.readStaged(tpm); key != nil {
+		log.Printf("Completing interrupted update of TPM NV index 0x%x", t.NVIndex)
+		if err := t.replace(tpm, key); err != nil {
+			return "", fmt.Errorf("failed to restore staged key: %w", err)
+		}
+		if err := t.scratch().undefine(tpm); err != nil {
+			log.Printf("Warning: Failed to remove TPM NV index 0x%x: %v", ScratchIndex(t.NVIndex), err)
 		}
-		return "", fmt.Errorf("failed to read from TPM: %w", err)
+		return string(key), nil
 	}
 
-	key := strings.TrimSpace(string(output))
-	if key == "" {
+	log.Printf("Reading from TPM NV index 0x%x", t.NVIndex)
+	data, sealed, err := t.read(tpm)
+	if errors.Is(err, ErrIndexNotDefined) && t.LegacyNVIndex != 0 {
+		return t.moveLegacy(tpm, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read key from TPM index 0x%x: %w", t.NVIndex, err)
+	}
+
+	if len(data) == 0 {
 		return "", fmt.Errorf("empty key retrieved from TPM")
 	}
 
-	return key, nil
+	// A move interrupted before the legacy index was removed leaves a stale
+	// copy of the key behind.
+	if t.LegacyNVIndex != 0 {
+		legacy := &TPMStorage{NVIndex: t.LegacyNVIndex}
+		if err := legacy.undefine(tpm); err == nil {
+			log.Printf("Removed stale key copy at TPM NV index 0x%x", legacy.NVIndex)
+		} else if !errors.Is(err, ErrIndexNotDefined) {
+			log.Printf("Warning: Failed to remove TPM NV index 0x%x: %v", legacy.NVIndex, err)
+		}
+	}
+
+	if !sealed && t.Sealed() {
+		log.Printf("Key at TPM NV index 0x%x is not sealed, sealing it to PCRs %v", t.NVIndex, t.PCRs)
+		if err := t.store(tpm, string(data)); err != nil {
+			return "", fmt.Errorf("failed to seal existing key: %w", err)
+		}
+	}
+
+	return string(data), nil
 }
 
-func (t *TPMStorage) cleanup() {
-	cmd := exec.Command("tpm2_nvundefine", t.NVIndex)
-	cmd.Env = append(cmd.Environ(), fmt.Sprintf("TPM2TOOLS_TCTI=%s", TCTIDevice))
-	cmd.Run()
+// moveLegacy returns the key kept at LegacyNVIndex and moves it to
+// NVIndex. The legacy index is only removed once the key is stored, so a
+// crash in between leaves it readable from either. notDefined is returned
+// if there is no legacy key either.
+func (t *TPMStorage) moveLegacy(tpm transport.TPM, notDefined error) (string, error) {
+	legacy := &TPMStorage{NVIndex: t.LegacyNVIndex, PCRs: t.PCRs}
+	data, _, err := legacy.read(tpm)
+	if errors.Is(err, ErrIndexNotDefined) {
+		return "", fmt.Errorf("failed to read key from TPM index 0x%x: %w", t.NVIndex, notDefined)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read key from legacy TPM index 0x%x: %w", legacy.NVIndex, err)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("empty key retrieved from TPM")
+	}
+
+	log.Printf("Moving key from TPM NV index 0x%x to 0x%x", legacy.NVIndex, t.NVIndex)
+	if err := t.store(tpm, string(data)); err != nil {
+		return "", fmt.Errorf("failed to move key from legacy TPM index: %w", err)
+	}
+	if err := legacy.undefine(tpm); err != nil {
+		log.Printf("Warning: Failed to remove TPM NV index 0x%x: %v", legacy.NVIndex, err)
+	}
+	return string(data), nil
+}
+
+// policyDigest computes the PolicyPCR digest for the configured PCRs using
+// their current values, via a trial session on the TPM.
+func (t *TPMStorage) policyDigest(tpm transport.TPM) ([]byte, error) {
+	sess, closer, err := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16, tpm2.Trial())
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer closer()
+
+	if err := t.policyPCR(tpm, sess.Handle()); err != nil {
+		return nil, err
+	}
+
+	rsp, err := tpm2.PolicyGetDigest{PolicySession: sess.Handle()}.Execute(tpm)
+	if err != nil {
+		return nil, classify(err)
+	}
+	return rsp.PolicyDigest.Buffer, nil
+}
+
+func (t *TPMStorage) policyPCR(tpm transport.TPM, session tpm2.TPMISHPolicy) error {
+	policy := tpm2.PolicyPCR{
+		PolicySession: session,
+		Pcrs: tpm2.TPMLPCRSelection{
+			PCRSelections: []tpm2.TPMSPCRSelection{{
+				Hash:      tpm2.TPMAlgSHA256,
+				PCRSelect: tpm2.PCClientCompatible.PCRs(t.PCRs...),
+			}},
+		},
+	}
+	if _, err := policy.Execute(tpm); err != nil {
+		return classify(err)
+	}
+	return nil
 }
 
 func (t *TPMStorage) Clear() error {
 	if !t.Available() {
-		return fmt.Errorf("TPM device not available")
+		return ErrNotAvailable
 	}
 
-	cmd := exec.Command("tpm2_nvundefine", t.NVIndex)
-	cmd.Env = append(cmd.Environ(), fmt.Sprintf("TPM2TOOLS_TCTI=%s", TCTIDevice))
-	if err := cmd.Run(); err != nil {
+	tpm, err := openTPM()
+	if err != nil {
+		return err
+	}
+	defer tpm.Close()
+
+	if err := t.undefine(tpm); err != nil {
+		return fmt.Errorf("failed to clear TPM NV index: %w", err)
+	}
+	if err := t.scratch().undefine(tpm); err != nil && !errors.Is(err, ErrIndexNotDefined) {
 		return fmt.Errorf("failed to clear TPM NV index: %w", err)
 	}
-	
+
+	return nil
+}
+
+func (t *TPMStorage) write(tpm transport.TPM, data []byte) error {
+	name, err := t.name(tpm)
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(data); offset += maxNVChunk {
+		end := min(offset+maxNVChunk, len(data))
+		write := tpm2.NVWrite{
+			AuthHandle: tpm2.AuthHandle{
+				Handle: tpm2.TPMRHOwner,
+				Auth:   tpm2.PasswordAuth(nil),
+			},
+			NVIndex: tpm2.NamedHandle{
+				Handle: tpm2.TPMHandle(t.NVIndex),
+				Name:   name,
+			},
+			Data:   tpm2.TPM2BMaxNVBuffer{Buffer: data[offset:end]},
+			Offset: uint16(offset),
+		}
+		if _, err := write.Execute(tpm); err != nil {
+			return classify(err)
+		}
+	}
+
+	return nil
+}
+
+// read returns the contents of the NV index and whether the index is sealed
+// to a PCR policy.
+func (t *TPMStorage) read(tpm transport.TPM) ([]byte, bool, error) {
+	pub, err := tpm2.NVReadPublic{NVIndex: tpm2.TPMHandle(t.NVIndex)}.Execute(tpm)
+	if err != nil {
+		return nil, false, classify(err)
+	}
+
+	contents, err := pub.NVPublic.Contents()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse NV public area: %w", err)
+	}
+
+	// The index's own attributes decide how it is read, so a key stored
+	// before sealing was configured can still be retrieved.
+	sealed := contents.Attributes.PolicyRead && !contents.Attributes.OwnerRead
+	if sealed && !t.Sealed() {
+		return nil, true, fmt.Errorf("%w: index 0x%x is sealed but no PCRs are configured", ErrUnsealFailed, t.NVIndex)
+	}
+
+	auth := tpm2.AuthHandle{
+		Handle: tpm2.TPMRHOwner,
+		Auth:   tpm2.PasswordAuth(nil),
+	}
+	if sealed {
+		auth = tpm2.AuthHandle{
+			Handle: tpm2.TPMHandle(t.NVIndex),
+			Name:   pub.NVName,
+			Auth: tpm2.Policy(tpm2.TPMAlgSHA256, 16, func(tpm transport.TPM, handle tpm2.TPMISHPolicy, _ tpm2.TPM2BNonce) error {
+				return t.policyPCR(tpm, handle)
+			}),
+		}
+	}
+
+	var data []byte
+	for offset := 0; offset < int(contents.DataSize); offset += maxNVChunk {
+		size := min(maxNVChunk, int(contents.DataSize)-offset)
+		read := tpm2.NVRead{
+			AuthHandle: auth,
+			NVIndex: tpm2.NamedHandle{
+				Handle: tpm2.TPMHandle(t.NVIndex),
+				Name:   pub.NVName,
+			},
+			Size:   uint16(size),
+			Offset: uint16(offset),
+		}
+		rsp, err := read.Execute(tpm)
+		if err != nil {
+			if sealed && errors.Is(err, tpm2.TPMRCPolicyFail) {
+				return nil, true, fmt.Errorf("%w: %v", ErrUnsealFailed, err)
+			}
+			return nil, sealed, classify(err)
+		}
+		data = append(data, rsp.Data.Buffer...)
+	}
+
+	return data, sealed, nil
+}
+
+func (t *TPMStorage) undefine(tpm transport.TPM) error {
+	name, err := t.name(tpm)
+	if err != nil {
+		return err
+	}
+
+	undefine := tpm2.NVUndefineSpace{
+		AuthHandle: tpm2.TPMRHOwner,
+		NVIndex: tpm2.NamedHandle{
+			Handle: tpm2.TPMHandle(t.NVIndex),
+			Name:   name,
+		},
+	}
+	if _, err := undefine.Execute(tpm); err != nil {
+		return classify(err)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+func (t *TPMStorage) name(tpm transport.TPM) (tpm2.TPM2BName, error) {
+	pub, err := tpm2.NVReadPublic{NVIndex: tpm2.TPMHandle(t.NVIndex)}.Execute(tpm)
+	if err != nil {
+		return tpm2.TPM2BName{}, classify(err)
+	}
+	return pub.NVName, nil
+}
+
+func openTPM() (transport.TPMCloser, error) {
+	tpm, err := linuxtpm.Open(TPMDevice)
+	if err != nil {
+		if errors.Is(err, syscall.EBUSY) {
+			return nil, fmt.Errorf("%w: %v", ErrDeviceBusy, err)
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", TPMDevice, err)
+	}
+	return tpm, nil
+}
+
+// classify maps TPM response codes onto the package's sentinel errors so
+// callers can branch with errors.Is instead of inspecting raw codes.
+func classify(err error) error {
+	switch {
+	case errors.Is(err, tpm2.TPMRCHandle), errors.Is(err, tpm2.TPMRCNVUninitialized):
+		return fmt.Errorf("%w: %v", ErrIndexNotDefined, err)
+	case errors.Is(err, tpm2.TPMRCAuthFail), errors.Is(err, tpm2.TPMRCBadAuth),
+		errors.Is(err, tpm2.TPMRCNVAuthorization), errors.Is(err, tpm2.TPMRCPolicyFail),
+		errors.Is(err, tpm2.TPMRCLockout):
+		return fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	case errors.Is(err, tpm2.TPMRCRetry), errors.Is(err, tpm2.TPMRCYielded),
+		errors.Is(err, tpm2.TPMRCTesting), errors.Is(err, tpm2.TPMRCNVRate),
+		errors.Is(err, syscall.EBUSY):
+		return fmt.Errorf("%w: %v", ErrDeviceBusy, err)
+	default:
+		return err
+	}
+}
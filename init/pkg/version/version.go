@@ -0,0 +1,37 @@
+// Package version identifies the tdx-init build.
+package version
+
+import "runtime/debug"
+
+// Version is set at build time with
+// -ldflags "-X github.com/NethermindEth/nethermind-tdx/init/pkg/version.Version=<version>".
+var Version string
+
+// String returns Version if it was set, otherwise the VCS revision the Go
+// toolchain recorded, otherwise "dev".
+func String() string {
+	if Version != "" {
+		return Version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "dev"
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
@@ -11,5 +11,5 @@ make_git_package \
     "tdx-init" \
     "$TDX_INIT_VERSION" \
     "$TDX_INIT_GIT_URL" \
-    'cd init && go build -trimpath -ldflags "-s -w -buildid=" -o ./build/tdx-init ./cmd/main.go' \
+    'cd init && go build -trimpath -ldflags "-s -w -buildid= -X github.com/NethermindEth/nethermind-tdx/init/pkg/version.Version='"$TDX_INIT_VERSION"'" -o ./build/tdx-init ./cmd/main.go' \
     "init/build/tdx-init:$TDX_INIT_BINARY_PATH"